@@ -2,22 +2,32 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"github.com/LukeHagar/plexgo"
-	"github.com/LukeHagar/plexgo/models/operations"
 	"github.com/gofiber/fiber/v3/middleware/session"
 	"github.com/gofiber/fiber/v3/middleware/static"
 	"github.com/google/uuid"
 	"io"
+	"log"
+	"net"
 	"net/url"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gofiber/fiber/v3"
 	"github.com/gofiber/storage/sqlite3"
 )
 
+var (
+	errClientDisconnected = errors.New("client disconnected")
+	errServerShutdown     = errors.New("server shutting down")
+)
+
 var storage = sqlite3.New()
 
 var store = session.New(session.Config{
@@ -38,12 +48,20 @@ const (
 	sessKeyClientID  = "clientID"
 	sessKeyPinID     = "pinID"
 	sessKeyAuthUrl   = "authURL"
+
+	// headerMediaID is the ID of the version of the item that a clip or preview was encoded from
+	headerMediaID = "X-Media-Id"
 )
 
 type API struct {
 	config Config
 	app    *Application
 	http   *fiber.App
+	jobs   *Jobs
+
+	indexingMu sync.Mutex
+	// indexing is the section key of the library whose quotes are being indexed
+	indexing string
 }
 
 func NewAPI(config Config, app *Application) (*API, error) {
@@ -51,12 +69,28 @@ func NewAPI(config Config, app *Application) (*API, error) {
 		config: config,
 		app:    app,
 		http:   fiber.New(),
+		jobs:   NewJobs(),
 	}
 
 	api.http.Get("/sessions", api.getSessions, api.authMiddleware)
 	api.http.Get("/thumb", api.thumb, api.authMiddleware)
+	api.http.Get("/capabilities", api.capabilities, api.authMiddleware)
+	api.http.Get("/clip/:ratingKey/chapter/:chapter", api.clipChapter, api.authMiddleware)
 	api.http.Get("/clip/:ratingKey/:from/:to", api.clip, api.authMiddleware)
+	// HLS routes must be registered before the progressive preview route, which would otherwise match them
+	api.http.Get("/preview/:ratingKey/index.m3u8", api.previewPlaylist, api.authMiddleware)
+	api.http.Get("/preview/:ratingKey/segment/:segment", api.previewSegment, api.authMiddleware)
 	api.http.Get("/preview/:ratingKey/:from/:to", api.preview, api.authMiddleware)
+	api.http.Post("/compilations", api.compilation, api.authMiddleware)
+	api.http.Get("/quotes/search", api.searchQuotes, api.authMiddleware)
+	api.http.Get("/quotes/:id/clip", api.clipQuote, api.authMiddleware)
+	api.http.Post("/quotes/index/library/:sectionKey", api.indexLibraryQuotes, api.authMiddleware)
+	api.http.Post("/quotes/index/:ratingKey", api.indexQuotes, api.authMiddleware)
+	api.http.Get("/screenshot/:ratingKey/:at", api.screenshot, api.authMiddleware)
+	api.http.Get("/media/:ratingKey/chapters", api.chapters, api.authMiddleware)
+	api.http.Get("/media/:ratingKey/versions", api.versions, api.authMiddleware)
+	api.http.Get("/media/:ratingKey/filmstrip", api.filmstrip, api.authMiddleware)
+	api.http.Get("/media/:ratingKey/frame", api.frame, api.authMiddleware)
 
 	api.http.Get("/authUrl", api.authUrl).Name(routeNameAuthUrl)
 
@@ -192,6 +226,39 @@ func (a *API) Start() error {
 	return a.http.Listen(a.config.API.ListenAddr)
 }
 
+// Shutdown stops accepting new encodes and waits for running encodes to finish. Encodes still running when ctx is
+// done are stopped. The HTTP server and session storage are then shut down.
+func (a *API) Shutdown(ctx context.Context) error {
+	var errs []error
+
+	if err := a.jobs.Drain(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("encodes did not finish in time: %w", err))
+	}
+
+	// Encodes are done by now so the HTTP server only needs a moment to finish writing responses
+	httpCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := a.http.ShutdownWithContext(httpCtx); err != nil {
+		errs = append(errs, fmt.Errorf("could not shut down http server: %w", err))
+	}
+
+	if err := storage.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("could not close session storage: %w", err))
+	}
+
+	return errors.Join(errs...)
+}
+
+// startJob registers an encode with the jobs tracker, failing the request if the server is shutting down
+func (a *API) startJob() (done func(), err error) {
+	done, ok := a.jobs.Start()
+	if !ok {
+		return nil, fiber.NewError(fiber.StatusServiceUnavailable, "server is shutting down")
+	}
+	return done, nil
+}
+
 func (a *API) getSessions(ctx fiber.Ctx) error {
 	sessions, err := a.app.GetSessions(ctx.UserContext())
 	if err != nil {
@@ -201,6 +268,10 @@ func (a *API) getSessions(ctx fiber.Ctx) error {
 	return ctx.JSON(sessions)
 }
 
+func (a *API) capabilities(ctx fiber.Ctx) error {
+	return ctx.JSON(a.app.capabilities)
+}
+
 func (a *API) clip(ctx fiber.Ctx) error {
 	ratingKeyStr := ctx.Params("ratingKey")
 	if ratingKeyStr == "" {
@@ -219,6 +290,27 @@ func (a *API) clip(ctx fiber.Ctx) error {
 		return fmt.Errorf("to not specified")
 	}
 
+	return a.sendClip(ctx, ratingKeyStr, mediaIdStr, from, to, "")
+}
+
+func (a *API) clipChapter(ctx fiber.Ctx) error {
+	ratingKeyStr := ctx.Params("ratingKey")
+	if ratingKeyStr == "" {
+		return fmt.Errorf("ratingKey not specified")
+	}
+
+	mediaIdStr := ctx.Query("mediaId")
+
+	chapter, err := url.PathUnescape(ctx.Params("chapter"))
+	if err != nil || chapter == "" {
+		return fmt.Errorf("chapter not specified")
+	}
+
+	return a.sendClip(ctx, ratingKeyStr, mediaIdStr, "", "", chapter)
+}
+
+// sendClip encodes and sends the clip of the from-to range or the chapter, using the options in the query
+func (a *API) sendClip(ctx fiber.Ctx, ratingKeyStr, mediaIdStr, from, to, chapter string) error {
 	heightStr := ctx.Query("height", "0")
 	height, err := strconv.Atoi(heightStr)
 	if err != nil {
@@ -231,11 +323,118 @@ func (a *API) clip(ctx fiber.Ctx) error {
 		return fmt.Errorf("qp not an integer")
 	}
 
-	filePath, err := a.app.Clip(ctx.UserContext(), ratingKeyStr, mediaIdStr, from, to, height, qp)
+	codec := a.config.Ffmpeg.Codec
+	if codecStr := ctx.Query("codec"); codecStr != "" {
+		codec, err = ParseAvailableCodec(codecStr)
+		if err != nil {
+			return err
+		}
+	}
+
+	hdrMode := a.config.Ffmpeg.HDR
+	if hdrStr := ctx.Query("hdr"); hdrStr != "" {
+		hdrMode, err = ParseHDRMode(hdrStr)
+		if err != nil {
+			return err
+		}
+	}
+
+	intro, err := ParseMarkerMode(ctx.Query("intro"))
+	if err != nil {
+		return err
+	}
+
+	credits, err := ParseMarkerMode(ctx.Query("credits"))
+	if err != nil {
+		return err
+	}
+
+	overlay, err := a.overlay(ctx)
+	if err != nil {
+		return err
+	}
+
+	framing, err := framing(ctx)
+	if err != nil {
+		return err
+	}
+
+	speed, err := ParseSpeed(ctx.Query("speed"))
+	if err != nil {
+		return err
+	}
+
+	fps, err := ParseFPS(ctx.Query("fps"))
+	if err != nil {
+		return err
+	}
+
+	var fade Fade
+	if fadeInStr := ctx.Query("fadeIn"); fadeInStr != "" {
+		fade.In, err = ParseTimestamp(fadeInStr)
+		if err != nil {
+			return fmt.Errorf("could not parse fadeIn: %w", err)
+		}
+	}
+	if fadeOutStr := ctx.Query("fadeOut"); fadeOutStr != "" {
+		fade.Out, err = ParseTimestamp(fadeOutStr)
+		if err != nil {
+			return fmt.Errorf("could not parse fadeOut: %w", err)
+		}
+	}
+
+	downmix, err := ParseDownmix(ctx.Query("downmix"))
+	if err != nil {
+		return err
+	}
+
+	audioFormat, err := ParseAudioFormat(ctx.Query("format"))
+	if err != nil {
+		return err
+	}
+
+	opts := ClipOptions{
+		Codec:   codec,
+		Height:  height,
+		QP:      qp,
+		HDRMode: hdrMode,
+		Overlay: overlay,
+		Framing: framing,
+		Playback: Playback{
+			Speed:       speed,
+			Reverse:     ctx.Query("reverse") == "true",
+			Boomerang:   ctx.Query("boomerang") == "true",
+			FPS:         fps,
+			Interpolate: ctx.Query("interpolate") == "true",
+		},
+		Audio: Audio{
+			Normalize: ctx.Query("normalize") == "true",
+			Downmix:   downmix,
+			Format:    audioFormat,
+		},
+		Fade: fade,
+	}
+
+	jobDone, err := a.startJob()
 	if err != nil {
 		return err
 	}
 
+	clipCtx, stop := a.requestContext(ctx)
+	from, to, err = a.app.ClipRange(clipCtx, ratingKeyStr, from, to, chapter, intro, credits)
+	var filePath string
+	var mediaID int
+	if err == nil {
+		filePath, mediaID, err = a.app.Clip(clipCtx, ratingKeyStr, mediaIdStr, from, to, opts)
+	}
+	stop()
+	jobDone()
+	if err != nil {
+		return err
+	}
+
+	ctx.Set(headerMediaID, strconv.Itoa(mediaID))
+
 	fileName := filepath.Base(filePath)
 	ctx.Type(filepath.Ext(fileName))
 	ctx.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="%s"`, fileName))
@@ -269,70 +468,837 @@ func (a *API) preview(ctx fiber.Ctx) error {
 		return fmt.Errorf("ratingKey not specified")
 	}
 
-	ratingKey, err := strconv.ParseFloat(ratingKeyStr, 0)
-	if err != nil {
-		return fmt.Errorf("could not parse rating key: %w", err)
-	}
-
 	mediaIdStr := ctx.Query("mediaId")
 
-	from := ctx.Params("from")
+	// The range is used by the stream writer after the handler has returned, so it's copied out of the request
+	from := strings.Clone(ctx.Params("from"))
 	if from == "" {
 		return fmt.Errorf("from not specified")
 	}
 
-	to := ctx.Params("to")
+	to := strings.Clone(ctx.Params("to"))
 	if to == "" {
 		return fmt.Errorf("to not specified")
 	}
 
-	libraryMetadata, err := a.app.plexAdmin.Library.GetMetadata(ctx.UserContext(), ratingKey)
+	metadata, err := a.app.metadata(ctx.UserContext(), ratingKeyStr)
+	if err != nil {
+		return err
+	}
+
+	heightStr := ctx.Query("height", "0")
+	height, err := strconv.Atoi(heightStr)
+	if err != nil {
+		return fmt.Errorf("height not an integer")
+	}
+
+	codec := a.app.capabilities.Usable(a.config.Ffmpeg.Codec.H264())
+
+	// Previews are tonemapped and default to 720p
+	media, err := a.app.selectMedia(*metadata, mediaIdStr, MediaTarget{
+		Height:  previewParams(FfmpegParams{Height: height}).Height,
+		Codec:   codec,
+		HDRMode: HDRModeTonemap,
+	})
+	if err != nil {
+		return err
+	}
+
+	input, err := a.app.partInput(mediaParts(*media), from, to)
+	if err != nil {
+		return err
+	}
+
+	qpStr := ctx.Query("qp", "0")
+	qp, err := strconv.Atoi(qpStr)
+	if err != nil {
+		return fmt.Errorf("qp not an integer")
+	}
+
+	params := FfmpegParams{
+		URL:    input.URL,
+		Offset: input.Offset,
+		List:   input.List,
+		From:   from,
+		To:     to,
+		Height: height,
+		QP:     qp,
+		Codec:  codec,
+		Source: NewVideoSource(*media),
+	}
+
+	jobDone, err := a.startJob()
 	if err != nil {
-		return fmt.Errorf("could not get library metadata: %w", err)
+		return err
+	}
+
+	ctx.Response().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer jobDone()
+
+		// The stream writer runs after this handler has returned, so it can't use the request's context
+		streamCtx, cancel := context.WithCancelCause(a.jobs.Context())
+		defer cancel(nil)
+
+		// Writes fail once the client has disconnected, at which point there's no point continuing to encode
+		cw := &countingWriter{w: w, onError: cancel}
+
+		params.Device = a.app.devices.Acquire(params.Codec)
+		err := DoFfmpegPreview(streamCtx, params, cw)
+		a.app.devices.Release(params.Device)
+
+		// The software encoder can only take over if the failed hardware encode hasn't streamed anything yet
+		if err != nil && streamCtx.Err() == nil && cw.n == 0 && params.Codec.HWAccel() != HWAccelNone {
+			log.Printf("preview with %s on %s failed, falling back to %s: %v", params.Codec, params.Device, params.Codec.Software(), err)
+			params.Codec = params.Codec.Software()
+			params.Device = ""
+			_ = DoFfmpegPreview(streamCtx, params, cw)
+		}
+	})
+
+	ctx.Set("Content-Type", "video/mp4")
+	ctx.Set(headerMediaID, strconv.Itoa(deref(media.ID)))
+
+	return nil
+}
+
+func (a *API) previewPlaylist(ctx fiber.Ctx) error {
+	ratingKeyStr := ctx.Params("ratingKey")
+	if ratingKeyStr == "" {
+		return fmt.Errorf("ratingKey not specified")
 	}
 
-	metadata := libraryMetadata.Object.MediaContainer.Metadata[0]
+	mediaIdStr := ctx.Query("mediaId")
 
-	var media *operations.GetMetadataMedia
-	if mediaIdStr != "" {
-		mediaId, err := strconv.Atoi(mediaIdStr)
+	var from, to time.Duration
+	var err error
+	if fromStr := ctx.Query("from"); fromStr != "" {
+		from, err = ParseTimestamp(fromStr)
 		if err != nil {
-			return fmt.Errorf("could not parse media id: %w", err)
+			return err
 		}
+	}
+	if toStr := ctx.Query("to"); toStr != "" {
+		to, err = ParseTimestamp(toStr)
+		if err != nil {
+			return err
+		}
+	}
 
-		for _, m := range metadata.Media {
-			if m.ID != nil && *m.ID == mediaId {
-				media = &m
-			}
+	sess, err := store.Get(ctx)
+	if err != nil {
+		return err
+	}
+
+	playlist, mediaID, err := a.app.PreviewPlaylist(ctx.UserContext(), sess.ID(), ratingKeyStr, mediaIdStr, from, to)
+	if err != nil {
+		return err
+	}
+
+	ctx.Set(fiber.HeaderContentType, "application/vnd.apple.mpegurl")
+	ctx.Set(headerMediaID, strconv.Itoa(mediaID))
+	ctx.Set(fiber.HeaderCacheControl, "no-cache")
+
+	return ctx.SendString(playlist)
+}
+
+func (a *API) previewSegment(ctx fiber.Ctx) error {
+	ratingKeyStr := ctx.Params("ratingKey")
+	if ratingKeyStr == "" {
+		return fmt.Errorf("ratingKey not specified")
+	}
+
+	index, err := strconv.Atoi(strings.TrimSuffix(ctx.Params("segment"), ".ts"))
+	if err != nil {
+		return fmt.Errorf("segment not an integer")
+	}
+
+	mediaId, err := strconv.Atoi(ctx.Query("mediaId"))
+	if err != nil {
+		return fmt.Errorf("mediaId not an integer")
+	}
+
+	sess, err := store.Get(ctx)
+	if err != nil {
+		return err
+	}
+
+	jobDone, err := a.startJob()
+	if err != nil {
+		return err
+	}
+
+	segmentCtx, stop := a.requestContext(ctx)
+	filePath, err := a.app.PreviewSegment(segmentCtx, sess.ID(), ratingKeyStr, mediaId, index)
+	stop()
+	jobDone()
+	if err != nil {
+		return err
+	}
+
+	ctx.Set(fiber.HeaderContentType, "video/mp2t")
+
+	return ctx.SendFile(filePath)
+}
+
+type countingWriter struct {
+	w       io.Writer
+	n       int64
+	onError func(error)
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	if err == nil {
+		// Flush so that the client receives the stream as it's encoded, and so that disconnects are noticed promptly
+		if f, ok := c.w.(interface{ Flush() error }); ok {
+			err = f.Flush()
 		}
 	}
+	if err != nil && c.onError != nil {
+		c.onError(err)
+	}
+	return n, err
+}
 
-	if media == nil {
-		for _, m := range metadata.Media {
-			// 10 bit encoding doesn't work correctly on NVIDIA hardware (and maybe others)
-			if m.VideoProfile != nil && *m.VideoProfile == "main 10" {
-				continue
-			}
-			media = &m
-			break
+type compilationRequest struct {
+	Title string `json:"title"`
+	// Crossfade is the length of the transition between segments in seconds
+	Crossfade float64              `json:"crossfade"`
+	Codec     string               `json:"codec"`
+	Height    int                  `json:"height"`
+	QP        int                  `json:"qp"`
+	Segments  []CompilationSegment `json:"segments"`
+}
+
+func (a *API) compilation(ctx fiber.Ctx) error {
+	var req compilationRequest
+	if err := ctx.Bind().JSON(&req); err != nil {
+		return fmt.Errorf("could not parse compilation: %w", err)
+	}
+
+	opts := CompilationOptions{
+		Title:     req.Title,
+		Crossfade: time.Duration(req.Crossfade * float64(time.Second)),
+		Codec:     a.config.Ffmpeg.Codec,
+		Height:    req.Height,
+		QP:        req.QP,
+	}
+
+	if req.Codec != "" {
+		var err error
+		opts.Codec, err = ParseAvailableCodec(req.Codec)
+		if err != nil {
+			return err
 		}
 	}
 
-	if media == nil {
-		return fmt.Errorf("could not find suitable media for rating key")
+	jobDone, err := a.startJob()
+	if err != nil {
+		return err
 	}
 
-	fileURL := fmt.Sprintf("%s%s?X-Plex-Token=%s",
-		a.config.Plex.Host,
-		*media.Part[0].Key,
-		a.config.Plex.Token,
-	)
+	compilationCtx, stop := a.requestContext(ctx)
+	filePath, err := a.app.Compilation(compilationCtx, req.Segments, opts)
+	stop()
+	jobDone()
+	if err != nil {
+		return err
+	}
 
-	ctx.Response().SetBodyStreamWriter(func(w *bufio.Writer) {
-		_ = DoFfmpegPreview(fileURL, from, to, a.config.Ffmpeg.Codec, w)
+	fileName := filepath.Base(filePath)
+	ctx.Type(filepath.Ext(fileName))
+	ctx.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="%s"`, fileName))
+
+	return ctx.SendFile(filePath, fiber.SendFile{
+		ByteRange: true,
 	})
+}
 
-	ctx.Set("Content-Type", "video/mp4")
+// overlay builds the clip's overlay from the query and the overlay config
+func (a *API) overlay(ctx fiber.Ctx) (Overlay, error) {
+	textPosition, err := ParseTextPosition(ctx.Query("textPosition"))
+	if err != nil {
+		return Overlay{}, err
+	}
 
-	return nil
+	overlay := Overlay{
+		Text:         ctx.Query("text"),
+		TextPosition: textPosition,
+		Caption:      ctx.Query("caption") == "true",
+		Font:         a.config.Overlay.Font,
+	}
+
+	config := a.config.Overlay.Watermark
+	watermark := config.Always
+	if watermarkStr := ctx.Query("watermark"); watermarkStr != "" {
+		watermark = watermarkStr == "true"
+	}
+
+	if watermark {
+		if config.Image == "" {
+			return Overlay{}, fmt.Errorf("watermark image isn't configured")
+		}
+
+		overlay.Watermark = &Watermark{
+			Image:    config.Image,
+			Position: config.Position,
+			Opacity:  config.Opacity,
+			Scale:    config.Scale,
+		}
+
+		if positionStr := ctx.Query("watermarkPosition"); positionStr != "" {
+			overlay.Watermark.Position, err = ParseWatermarkPosition(positionStr)
+			if err != nil {
+				return Overlay{}, err
+			}
+		}
+	}
+
+	return overlay, nil
+}
+
+// framing builds the clip's crop and aspect ratio from the query
+func framing(ctx fiber.Ctx) (Framing, error) {
+	aspect, err := ParseAspectRatio(ctx.Query("aspect"))
+	if err != nil {
+		return Framing{}, err
+	}
+
+	mode, err := ParseFramingMode(ctx.Query("framing"))
+	if err != nil {
+		return Framing{}, err
+	}
+
+	framing := Framing{
+		Aspect: aspect,
+		Mode:   mode,
+	}
+
+	switch cropStr := ctx.Query("crop"); cropStr {
+	case "":
+	case "auto":
+		framing.AutoCrop = true
+	default:
+		framing.Crop, err = ParseCropRect(cropStr)
+		if err != nil {
+			return Framing{}, err
+		}
+	}
+
+	return framing, nil
+}
+
+type chapterResponse struct {
+	Index int    `json:"index"`
+	Title string `json:"title"`
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+type markerResponse struct {
+	Type  MarkerType `json:"type"`
+	Start string     `json:"start"`
+	End   string     `json:"end"`
+	Final bool       `json:"final"`
+}
+
+type chaptersResponse struct {
+	Chapters []chapterResponse `json:"chapters"`
+	Markers  []markerResponse  `json:"markers"`
+}
+
+func (a *API) chapters(ctx fiber.Ctx) error {
+	ratingKeyStr := ctx.Params("ratingKey")
+	if ratingKeyStr == "" {
+		return fmt.Errorf("ratingKey not specified")
+	}
+
+	chapters, err := a.app.Chapters(ctx.UserContext(), ratingKeyStr)
+	if err != nil {
+		return err
+	}
+
+	resp := chaptersResponse{
+		Chapters: []chapterResponse{},
+		Markers:  []markerResponse{},
+	}
+
+	for _, c := range chapters.Chapters {
+		resp.Chapters = append(resp.Chapters, chapterResponse{
+			Index: c.Index,
+			Title: c.Title,
+			Start: FormatTimestamp(c.Start),
+			End:   FormatTimestamp(c.End),
+		})
+	}
+
+	for _, m := range chapters.Markers {
+		resp.Markers = append(resp.Markers, markerResponse{
+			Type:  m.Type,
+			Start: FormatTimestamp(m.Start),
+			End:   FormatTimestamp(m.End),
+			Final: m.Final,
+		})
+	}
+
+	return ctx.JSON(resp)
+}
+
+type versionsResponse struct {
+	EditionTitle string            `json:"editionTitle,omitempty"`
+	Versions     []versionResponse `json:"versions"`
+	Editions     []editionResponse `json:"editions"`
+}
+
+type versionResponse struct {
+	MediaID    int            `json:"mediaId"`
+	Title      string         `json:"title,omitempty"`
+	Resolution string         `json:"resolution"`
+	Width      int            `json:"width"`
+	Height     int            `json:"height"`
+	VideoCodec string         `json:"videoCodec"`
+	AudioCodec string         `json:"audioCodec"`
+	Container  string         `json:"container"`
+	Bitrate    int            `json:"bitrate"`
+	HDR        HDRFormat      `json:"hdr,omitempty"`
+	Duration   string         `json:"duration"`
+	Parts      []partResponse `json:"parts"`
+}
+
+type partResponse struct {
+	ID       int    `json:"id"`
+	File     string `json:"file"`
+	Start    string `json:"start"`
+	Duration string `json:"duration"`
+	Size     int    `json:"size"`
+}
+
+type editionResponse struct {
+	RatingKey    string `json:"ratingKey"`
+	EditionTitle string `json:"editionTitle"`
+}
+
+// versions lists the versions of an item that can be clipped with the mediaId query parameter, along with their parts
+// and the other editions of the item
+func (a *API) versions(ctx fiber.Ctx) error {
+	ratingKeyStr := ctx.Params("ratingKey")
+	if ratingKeyStr == "" {
+		return fmt.Errorf("ratingKey not specified")
+	}
+
+	versions, err := a.app.MediaVersions(ctx.UserContext(), ratingKeyStr)
+	if err != nil {
+		return err
+	}
+
+	resp := versionsResponse{
+		EditionTitle: versions.EditionTitle,
+		Versions:     []versionResponse{},
+		Editions:     []editionResponse{},
+	}
+
+	for _, v := range versions.Versions {
+		version := versionResponse{
+			MediaID:    v.ID,
+			Title:      v.Title,
+			Resolution: v.Resolution,
+			Width:      v.Width,
+			Height:     v.Height,
+			VideoCodec: v.VideoCodec,
+			AudioCodec: v.AudioCodec,
+			Container:  v.Container,
+			Bitrate:    v.Bitrate,
+			HDR:        v.HDR,
+			Duration:   FormatTimestamp(v.Duration),
+			Parts:      []partResponse{},
+		}
+
+		for _, p := range v.Parts {
+			version.Parts = append(version.Parts, partResponse{
+				ID:       deref(p.Part.ID),
+				File:     partName(p.Part),
+				Start:    FormatTimestamp(p.Start),
+				Duration: FormatTimestamp(p.Duration),
+				Size:     deref(p.Part.Size),
+			})
+		}
+
+		resp.Versions = append(resp.Versions, version)
+	}
+
+	for _, e := range versions.Editions {
+		resp.Editions = append(resp.Editions, editionResponse{
+			RatingKey:    e.RatingKey,
+			EditionTitle: e.EditionTitle,
+		})
+	}
+
+	return ctx.JSON(resp)
+}
+
+type quoteResponse struct {
+	ID        int64  `json:"id"`
+	RatingKey string `json:"ratingKey"`
+	MediaID   int    `json:"mediaId"`
+	Title     string `json:"title"`
+	Start     string `json:"start"`
+	End       string `json:"end"`
+	Text      string `json:"text"`
+	ClipURL   string `json:"clipUrl"`
+}
+
+func (a *API) searchQuotes(ctx fiber.Ctx) error {
+	limit, err := strconv.Atoi(ctx.Query("limit", "0"))
+	if err != nil {
+		return fmt.Errorf("limit not an integer")
+	}
+
+	quotes, err := a.app.SearchQuotes(ctx.Query("q"), limit)
+	if err != nil {
+		return err
+	}
+
+	resp := []quoteResponse{}
+	for _, q := range quotes {
+		resp = append(resp, quoteResponse{
+			ID:        q.ID,
+			RatingKey: q.RatingKey,
+			MediaID:   q.MediaID,
+			Title:     q.Title,
+			Start:     FormatTimestamp(q.Start),
+			End:       FormatTimestamp(q.End),
+			Text:      q.Text,
+			ClipURL:   fmt.Sprintf("/quotes/%d/clip", q.ID),
+		})
+	}
+
+	return ctx.JSON(resp)
+}
+
+func (a *API) clipQuote(ctx fiber.Ctx) error {
+	id, err := strconv.ParseInt(ctx.Params("id"), 10, 64)
+	if err != nil {
+		return fmt.Errorf("id not an integer")
+	}
+
+	padding, err := strconv.ParseFloat(ctx.Query("padding", "1"), 64)
+	if err != nil || padding < 0 {
+		return fmt.Errorf("padding not a positive number")
+	}
+
+	quote, err := a.app.Quote(id)
+	if err != nil {
+		return err
+	}
+
+	paddingDuration := time.Duration(padding * float64(time.Second))
+	from := FormatTimestamp(max(quote.Start-paddingDuration, 0))
+	to := FormatTimestamp(quote.End + paddingDuration)
+
+	return a.sendClip(ctx, quote.RatingKey, strconv.Itoa(quote.MediaID), from, to, "")
+}
+
+func (a *API) indexQuotes(ctx fiber.Ctx) error {
+	ratingKeyStr := ctx.Params("ratingKey")
+	if ratingKeyStr == "" {
+		return fmt.Errorf("ratingKey not specified")
+	}
+
+	jobDone, err := a.startJob()
+	if err != nil {
+		return err
+	}
+
+	indexCtx, stop := a.requestContext(ctx)
+	cues, err := a.app.IndexQuotes(indexCtx, ratingKeyStr, ctx.Query("language"))
+	stop()
+	jobDone()
+	if err != nil {
+		return err
+	}
+
+	return ctx.JSON(fiber.Map{"cues": cues})
+}
+
+// indexLibraryQuotes starts indexing a whole library in the background since it can take hours.
+// It isn't tracked as a job so that it doesn't hold up shutdown, and is stopped if running jobs are.
+func (a *API) indexLibraryQuotes(ctx fiber.Ctx) error {
+	// Request values are only valid until the handler returns, so they're copied for the background job
+	sectionKey := strings.Clone(ctx.Params("sectionKey"))
+	if sectionKey == "" {
+		return fmt.Errorf("sectionKey not specified")
+	}
+
+	language := strings.Clone(ctx.Query("language"))
+	force := ctx.Query("force") == "true"
+
+	// Indexing runs ffmpeg for every item, so libraries are indexed one at a time
+	a.indexingMu.Lock()
+	defer a.indexingMu.Unlock()
+
+	if a.indexing != "" {
+		return fiber.NewError(fiber.StatusConflict, fmt.Sprintf("library %s is already being indexed", a.indexing))
+	}
+
+	// The index is closed after the jobs have drained, so the indexer has to be tracked as a job
+	jobCtx, jobDone, ok := a.jobs.StartBackground()
+	if !ok {
+		return fiber.NewError(fiber.StatusServiceUnavailable, "server is shutting down")
+	}
+
+	a.indexing = sectionKey
+
+	go func() {
+		defer jobDone()
+
+		if err := a.app.IndexLibraryQuotes(jobCtx, sectionKey, language, force); err != nil {
+			log.Printf("could not index quotes for library %s: %v", sectionKey, err)
+		}
+
+		a.indexingMu.Lock()
+		a.indexing = ""
+		a.indexingMu.Unlock()
+	}()
+
+	return ctx.SendStatus(fiber.StatusAccepted)
+}
+
+func (a *API) screenshot(ctx fiber.Ctx) error {
+	ratingKeyStr := ctx.Params("ratingKey")
+	if ratingKeyStr == "" {
+		return fmt.Errorf("ratingKey not specified")
+	}
+
+	mediaIdStr := ctx.Query("mediaId")
+
+	atStr := ctx.Params("at")
+	if atStr == "" {
+		return fmt.Errorf("at not specified")
+	}
+	at, err := ParseTimestamp(atStr)
+	if err != nil {
+		return err
+	}
+
+	heightStr := ctx.Query("height", "0")
+	height, err := strconv.Atoi(heightStr)
+	if err != nil {
+		return fmt.Errorf("height not an integer")
+	}
+
+	format, err := ParseImageFormat(ctx.Query("format"))
+	if err != nil {
+		return err
+	}
+
+	hdrMode := a.config.Ffmpeg.HDR
+	if hdrStr := ctx.Query("hdr"); hdrStr != "" {
+		hdrMode, err = ParseHDRMode(hdrStr)
+		if err != nil {
+			return err
+		}
+	}
+
+	opts := ScreenshotOptions{
+		Format:           format,
+		Height:           height,
+		HDRMode:          hdrMode,
+		SubtitleStreamID: ctx.Query("subtitles"),
+	}
+
+	jobDone, err := a.startJob()
+	if err != nil {
+		return err
+	}
+
+	screenshotCtx, stop := a.requestContext(ctx)
+	filePath, fileName, err := a.app.Screenshot(screenshotCtx, ratingKeyStr, mediaIdStr, at, opts)
+	stop()
+	jobDone()
+	if err != nil {
+		return err
+	}
+
+	ctx.Type(format.Ext())
+	ctx.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="%s"`, fileName))
+
+	return ctx.SendFile(filePath)
+}
+
+type filmstripFrame struct {
+	Timestamp string `json:"timestamp"`
+	URL       string `json:"url"`
+}
+
+func (a *API) filmstrip(ctx fiber.Ctx) error {
+	ratingKeyStr := ctx.Params("ratingKey")
+	if ratingKeyStr == "" {
+		return fmt.Errorf("ratingKey not specified")
+	}
+
+	mediaIdStr := ctx.Query("mediaId")
+
+	var from, to time.Duration
+	var err error
+	if fromStr := ctx.Query("from"); fromStr != "" {
+		from, err = ParseTimestamp(fromStr)
+		if err != nil {
+			return err
+		}
+	}
+	if toStr := ctx.Query("to"); toStr != "" {
+		to, err = ParseTimestamp(toStr)
+		if err != nil {
+			return err
+		}
+	}
+
+	count, err := strconv.Atoi(ctx.Query("count", "10"))
+	if err != nil {
+		return fmt.Errorf("count not an integer")
+	}
+
+	height, err := strconv.Atoi(ctx.Query("height", strconv.Itoa(filmstripDefaultHeight)))
+	if err != nil {
+		return fmt.Errorf("height not an integer")
+	}
+
+	frameSource, err := ParseFrameSource(ctx.Query("source"))
+	if err != nil {
+		return err
+	}
+
+	// The JSON format only lists the frame URLs, the frames themselves are extracted when they're requested
+	if ctx.Query("format") == "json" {
+		source, err := a.app.MediaSource(ctx.UserContext(), ratingKeyStr, mediaIdStr)
+		if err != nil {
+			return err
+		}
+
+		if to <= 0 || to > source.Duration {
+			to = source.Duration
+		}
+		if from >= to {
+			return fmt.Errorf("from must be before to")
+		}
+		if count < 1 || count > filmstripMaxFrames {
+			return fmt.Errorf("count must be between 1 and %d", filmstripMaxFrames)
+		}
+
+		var frames []filmstripFrame
+		for _, t := range FilmstripTimestamps(from, to, count) {
+			frames = append(frames, filmstripFrame{
+				Timestamp: FormatTimestamp(t),
+				URL:       fmt.Sprintf("/media/%s/frame?t=%s&mediaId=%d&height=%d", url.PathEscape(ratingKeyStr), FormatTimestamp(t), source.MediaID, height),
+			})
+		}
+
+		return ctx.JSON(frames)
+	}
+
+	jobDone, err := a.startJob()
+	if err != nil {
+		return err
+	}
+
+	filmstripCtx, stop := a.requestContext(ctx)
+	filmstrip, err := a.app.Filmstrip(filmstripCtx, ratingKeyStr, mediaIdStr, from, to, count, height, frameSource)
+	stop()
+	jobDone()
+	if err != nil {
+		return err
+	}
+
+	timestamps := make([]string, len(filmstrip.Timestamps))
+	for i, t := range filmstrip.Timestamps {
+		timestamps[i] = FormatTimestamp(t)
+	}
+
+	ctx.Set(fiber.HeaderContentType, "image/jpeg")
+	ctx.Set("X-Filmstrip-Columns", strconv.Itoa(filmstrip.Columns))
+	ctx.Set("X-Filmstrip-Rows", strconv.Itoa(filmstrip.Rows))
+	ctx.Set("X-Filmstrip-Timestamps", strings.Join(timestamps, ","))
+
+	return ctx.Send(filmstrip.Image)
+}
+
+func (a *API) frame(ctx fiber.Ctx) error {
+	ratingKeyStr := ctx.Params("ratingKey")
+	if ratingKeyStr == "" {
+		return fmt.Errorf("ratingKey not specified")
+	}
+
+	mediaIdStr := ctx.Query("mediaId")
+
+	tStr := ctx.Query("t")
+	if tStr == "" {
+		return fmt.Errorf("t not specified")
+	}
+	t, err := ParseTimestamp(tStr)
+	if err != nil {
+		return err
+	}
+
+	height, err := strconv.Atoi(ctx.Query("height", "0"))
+	if err != nil {
+		return fmt.Errorf("height not an integer")
+	}
+
+	jobDone, err := a.startJob()
+	if err != nil {
+		return err
+	}
+
+	frameCtx, stop := a.requestContext(ctx)
+	filePath, err := a.app.Frame(frameCtx, ratingKeyStr, mediaIdStr, t, height)
+	stop()
+	jobDone()
+	if err != nil {
+		return err
+	}
+
+	ctx.Set(fiber.HeaderContentType, "image/jpeg")
+	ctx.Set(fiber.HeaderCacheControl, "private, max-age=3600")
+
+	return ctx.SendFile(filePath)
+}
+
+// requestContext returns a context for long-running work done by a handler, such as encoding.
+// It's cancelled when the client disconnects, when the shutdown grace period runs out, or when stop is called.
+// stop must be called before the handler returns.
+func (a *API) requestContext(ctx fiber.Ctx) (reqCtx context.Context, stop func()) {
+	reqCtx, cancel := context.WithCancelCause(ctx.UserContext())
+
+	// fasthttp doesn't notify handlers about disconnects, so watch for the client closing the connection by reading
+	// from it. Anything the client sends while waiting, such as a pipelined request, would be consumed by the watcher
+	// and the read deadline is changed to stop it, so the connection is closed after the response rather than being
+	// kept alive for another request. These requests take long enough that the cost of a new connection doesn't matter.
+	ctx.Context().SetConnectionClose()
+	conn := ctx.Context().Conn()
+	watchDone := make(chan struct{})
+	go func() {
+		defer close(watchDone)
+		_, err := conn.Read(make([]byte, 1))
+		var netErr net.Error
+		if err != nil && !(errors.As(err, &netErr) && netErr.Timeout()) {
+			cancel(errClientDisconnected)
+		}
+	}()
+
+	go func() {
+		select {
+		case <-a.jobs.Context().Done():
+			cancel(context.Cause(a.jobs.Context()))
+		case <-reqCtx.Done():
+		}
+	}()
+
+	return reqCtx, func() {
+		// Unblock the watcher's read and hand the connection back to fasthttp
+		_ = conn.SetReadDeadline(time.Now())
+		<-watchDone
+		_ = conn.SetReadDeadline(time.Time{})
+		cancel(nil)
+	}
 }
@@ -2,11 +2,17 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/LukeHagar/plexgo/models/components"
 	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
 	"strconv"
+	"time"
 
 	"github.com/LukeHagar/plexgo"
 	"github.com/LukeHagar/plexgo/models/operations"
@@ -21,20 +27,45 @@ type Application struct {
 	plexAdmin         *plexgo.PlexAPI
 	plexUser          *plexgo.PlexAPI
 	plexTv            *PlexTV
+	capabilities      *Capabilities
+	devices           *DevicePool
+	hls               *HLSCache
+	frames            *FrameCache
+	bifs              *BIFCache
+	quotes            *QuoteIndex
+	filenames         *FilenameTemplate
 	machineIdentifier string
 	ownerEmail        string
 }
 
 func NewApplication(config Config) (*Application, error) {
 	app := &Application{
-		config: config,
-		plexTv: NewPlexTV(config.Plex.Token),
+		config:  config,
+		plexTv:  NewPlexTV(config.Plex.Token),
+		devices: NewDevicePool(config.Ffmpeg.Devices),
+		hls:     NewHLSCache(filepath.Join("/tmp", "cutscene-hls")),
+		frames:  NewFrameCache(filepath.Join("/tmp", "cutscene-frames")),
+		bifs:    NewBIFCache(),
 		plexAdmin: plexgo.New(
 			plexgo.WithServerURL(config.Plex.Host),
 			plexgo.WithSecurity(config.Plex.Token),
 		),
 	}
 
+	filenames, err := ParseFilenameTemplate(config.Clip.Filename)
+	if err != nil {
+		return nil, err
+	}
+
+	app.filenames = filenames
+
+	quotes, err := NewQuoteIndex(config.Quotes.Database)
+	if err != nil {
+		return nil, err
+	}
+
+	app.quotes = quotes
+
 	identity, err := app.plexAdmin.Server.GetServerIdentity(context.Background())
 	if err != nil {
 		return nil, fmt.Errorf("could not get server identity: %w", err)
@@ -49,6 +80,12 @@ func NewApplication(config Config) (*Application, error) {
 
 	app.ownerEmail = *account.Object.MyPlex.Username
 
+	app.capabilities = ProbeCapabilities(app.devices)
+	app.capabilities.Log()
+	if !app.capabilities.IsWorking(config.Ffmpeg.Codec) {
+		log.Printf("configured codec %s is not working, clips will fall back to %s", config.Ffmpeg.Codec, config.Ffmpeg.Codec.Software())
+	}
+
 	// TODO: If configured, ignore auth from context and just use the configured token for all requests
 	app.plexUser = plexgo.New(
 		plexgo.WithServerURL(config.Plex.Host),
@@ -58,6 +95,11 @@ func NewApplication(config Config) (*Application, error) {
 	return app, nil
 }
 
+// Close removes the application's temporary files and closes the quote index
+func (a *Application) Close() error {
+	return errors.Join(a.hls.Close(), a.frames.Close(), a.quotes.Close())
+}
+
 func (a *Application) plexSecurityUserToken(ctx context.Context) (components.Security, error) {
 	authToken := AuthTokenFromContext(ctx)
 	if authToken == nil {
@@ -114,100 +156,283 @@ func (a *Application) GetSessions(ctx context.Context) ([]operations.GetSessions
 	return filteredSessions, nil
 }
 
-func (a *Application) Clip(ctx context.Context, ratingKeyStr, mediaIdStr, from, to string, height, qp int) (string, error) {
-	ratingKey, err := strconv.ParseFloat(ratingKeyStr, 0)
+// ClipOptions are the user-provided options that modify the resulting clip
+type ClipOptions struct {
+	Codec    Codec
+	Height   int
+	QP       int
+	HDRMode  HDRMode
+	Overlay  Overlay
+	Framing  Framing
+	Playback Playback
+	Audio    Audio
+	Fade     Fade
+}
+
+// Clip encodes the from-to range of the rating key's media and returns the path to the file and the ID of the
+// version it was encoded from
+func (a *Application) Clip(ctx context.Context, ratingKeyStr, mediaIdStr, from, to string, opts ClipOptions) (string, int, error) {
+	metadata, err := a.metadata(ctx, ratingKeyStr)
 	if err != nil {
-		return "", fmt.Errorf("could not parse rating key: %w", err)
+		return "", 0, err
 	}
 
-	libraryMetadata, err := a.plexAdmin.Library.GetMetadata(ctx, ratingKey)
+	media, err := a.selectMedia(*metadata, mediaIdStr, MediaTarget{
+		Height:  opts.Height,
+		Codec:   a.capabilities.Usable(opts.Codec),
+		HDRMode: opts.HDRMode,
+	})
+	if err != nil {
+		return "", 0, err
+	}
+
+	input, err := a.partInput(mediaParts(*media), from, to)
 	if err != nil {
-		return "", fmt.Errorf("could not get library metadata: %w", err)
+		return "", 0, err
 	}
 
-	metadata := libraryMetadata.Object.MediaContainer.Metadata[0]
+	if err := opts.Playback.Validate(from, to); err != nil {
+		return "", 0, err
+	}
+
+	paramsMetadata := NewFfmpegParamsMetadata(*metadata)
+
+	// Music has no video, so only the audio is exported
+	if paramsMetadata.IsAudio() && !opts.Audio.AudioOnly() {
+		opts.Audio.Format = AudioFormatM4A
+	}
 
-	var media *operations.GetMetadataMedia
-	if mediaIdStr != "" {
-		mediaId, err := strconv.Atoi(mediaIdStr)
+	if err := opts.Audio.Validate(); err != nil {
+		return "", 0, err
+	}
+
+	if !opts.Fade.IsZero() {
+		fromTime, err := ParseTimestamp(from)
+		if err != nil {
+			return "", 0, err
+		}
+		toTime, err := ParseTimestamp(to)
 		if err != nil {
-			return "", fmt.Errorf("could not parse media id: %w", err)
+			return "", 0, err
+		}
+		if err := opts.Fade.Validate(opts.Playback.Duration(toTime - fromTime)); err != nil {
+			return "", 0, err
 		}
+	}
+
+	clipRange := from + " - " + to
+	if playback := opts.Playback.String(); playback != "" {
+		clipRange += ", " + playback
+	}
+
+	fileName, err := a.filenames.Filename(FilenameData{
+		FfmpegParamsMetadata: paramsMetadata,
+		Name:                 paramsMetadata.Name(),
+		From:                 from,
+		To:                   to,
+		Range:                clipRange,
+	}, opts.Audio.Format.Ext())
+	if err != nil {
+		return "", 0, err
+	}
+
+	params := FfmpegParams{
+		URL:      input.URL,
+		Offset:   input.Offset,
+		List:     input.List,
+		From:     from,
+		To:       to,
+		Filename: fileName,
+		Codec:    a.capabilities.Usable(opts.Codec),
+		Height:   opts.Height,
+		QP:       opts.QP,
+		Source:   NewVideoSource(*media),
+		HDRMode:  opts.HDRMode,
+		Metadata: paramsMetadata,
+		Overlay:  opts.Overlay,
+		Framing:  opts.Framing,
+		Playback: opts.Playback,
+		Audio:    opts.Audio,
+		Fade:     opts.Fade,
+	}
 
-		for _, m := range metadata.Media {
-			if m.ID != nil && *m.ID == mediaId {
-				media = &m
+	// Episodes use the show's poster rather than their own thumbnail, which is a still from the episode.
+	// The thumbnail of a track is its album's cover.
+	poster := deref(metadata.Thumb)
+	if paramsMetadata.Type == MediaTypeEpisode {
+		show, err := a.Show(ctx, ratingKeyStr)
+		if err != nil {
+			log.Printf("could not get show of %s: %v", ratingKeyStr, err)
+		} else {
+			params.Metadata.Network = show.Network
+			if show.Poster != "" {
+				poster = show.Poster
 			}
 		}
 	}
 
-	if media == nil {
-		for _, m := range metadata.Media {
-			// 10 bit encoding doesn't work correctly on NVIDIA hardware (and maybe others)
-			if m.VideoProfile != nil && *m.VideoProfile == "main 10" {
-				continue
-			}
-			media = &m
-			break
+	// Audio-only exports don't use the GPU
+	if params.Audio.AudioOnly() {
+		params.Codec = params.Codec.Software()
+	}
+
+	ctx, cancel := a.jobContext(ctx)
+	defer cancel()
+
+	if params.Framing.AutoCrop && !params.Audio.AudioOnly() {
+		crop, err := DetectCrop(ctx, params)
+		if err != nil {
+			return "", 0, err
 		}
+		params.Framing.Crop = crop
 	}
 
-	if media == nil {
-		return "", fmt.Errorf("could not find suitable media for rating key")
+	if params.Audio.Normalize {
+		loudness, err := MeasureLoudness(ctx, params)
+		if err != nil {
+			return "", 0, err
+		}
+		params.Audio.Loudness = loudness
 	}
 
-	fileURL := fmt.Sprintf("%s%s?X-Plex-Token=%s",
-		a.config.Plex.Host,
-		*media.Part[0].Key,
-		a.config.Plex.Token,
-	)
+	params.Device = a.devices.Acquire(params.Codec)
+	filePath, err := DoFfmpeg(ctx, params)
+	a.devices.Release(params.Device)
 
-	var fileName string
-	if *metadata.Type == "episode" {
-		fileName = fmt.Sprintf("%s S%02dE%02d %s (%s - %s).mp4",
-			*metadata.GrandparentTitle,
-			*metadata.ParentIndex,
-			*metadata.Index,
-			*metadata.Title,
-			from,
-			to,
-		)
-	} else {
-		fileName = fmt.Sprintf("%s (%d) (%s - %s).mp4",
-			*metadata.Title,
-			*metadata.Year,
-			from,
-			to,
-		)
+	if err != nil && ctx.Err() == nil && params.Codec.HWAccel() != HWAccelNone {
+		log.Printf("clip with %s on %s failed, falling back to %s: %v", params.Codec, params.Device, params.Codec.Software(), err)
+		params.Codec = params.Codec.Software()
+		params.Device = ""
+		filePath, err = DoFfmpeg(ctx, params)
 	}
 
-	params := FfmpegParams{
-		URL:      fileURL,
-		From:     from,
-		To:       to,
-		Filename: fileName,
-		Codec:    a.config.Ffmpeg.Codec,
-		Height:   height,
-		QP:       qp,
-		Metadata: FfmpegParamsMetadata{
-			Title: *metadata.Title,
-		},
+	if err != nil {
+		return filePath, 0, err
+	}
+
+	a.attachCoverArt(ctx, poster, filePath, params.Audio.Format)
+
+	return filePath, deref(media.ID), nil
+}
+
+// attachCoverArt embeds the item's poster in the clip. Clips are still usable without it, so failures are only logged.
+func (a *Application) attachCoverArt(ctx context.Context, poster, filePath string, format AudioFormat) {
+	switch format {
+	case AudioFormatNone, AudioFormatM4A, AudioFormatMP3:
+	default:
+		return
+	}
+
+	imagePath, err := a.coverArt(ctx, poster, filepath.Dir(filePath))
+	if err != nil {
+		log.Printf("could not get cover art for %s: %v", filepath.Base(filePath), err)
+		return
+	}
+
+	defer os.Remove(imagePath)
+
+	if err := AttachCoverArt(ctx, filePath, imagePath, format); err != nil {
+		log.Printf("%v", err)
+	}
+}
+
+// MediaSource is a resolved version of a media item that can be encoded from
+type MediaSource struct {
+	MediaID int
+	// Parts are the files of the media, timestamps have to be mapped onto them with partInput or partAt
+	Parts    []MediaPart
+	Source   VideoSource
+	Duration time.Duration
+}
+
+// MediaSource looks up the version of the rating key's media to encode from
+func (a *Application) MediaSource(ctx context.Context, ratingKeyStr, mediaIdStr string) (*MediaSource, error) {
+	metadata, err := a.metadata(ctx, ratingKeyStr)
+	if err != nil {
+		return nil, err
+	}
+
+	media, err := a.selectMedia(*metadata, mediaIdStr, MediaTarget{})
+	if err != nil {
+		return nil, err
+	}
+
+	return a.newMediaSource(*metadata, *media), nil
+}
+
+func (a *Application) newMediaSource(metadata operations.GetMetadataMetadata, media operations.GetMetadataMedia) *MediaSource {
+	source := &MediaSource{
+		Parts:  mediaParts(media),
+		Source: NewVideoSource(media),
+	}
+
+	if media.ID != nil {
+		source.MediaID = *media.ID
+	}
+
+	if media.Duration != nil {
+		source.Duration = time.Duration(*media.Duration) * time.Millisecond
+	} else if metadata.Duration != nil {
+		source.Duration = time.Duration(*metadata.Duration) * time.Millisecond
+	}
+
+	return source
+}
+
+// metadata looks up the library metadata for the rating key
+func (a *Application) metadata(ctx context.Context, ratingKeyStr string) (*operations.GetMetadataMetadata, error) {
+	ratingKey, err := strconv.ParseFloat(ratingKeyStr, 0)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse rating key: %w", err)
+	}
+
+	libraryMetadata, err := a.plexAdmin.Library.GetMetadata(ctx, ratingKey)
+	if err != nil {
+		return nil, fmt.Errorf("could not get library metadata: %w", err)
+	}
+
+	if len(libraryMetadata.Object.MediaContainer.Metadata) == 0 {
+		return nil, fmt.Errorf("could not find metadata for rating key")
 	}
 
-	if metadata.GrandparentTitle != nil {
-		params.Metadata.Show = *metadata.GrandparentTitle
+	metadata := &libraryMetadata.Object.MediaContainer.Metadata[0]
+	if err := checkMediaType(*metadata); err != nil {
+		return nil, err
 	}
-	if metadata.ParentIndex != nil {
-		params.Metadata.SeasonNumber = *metadata.ParentIndex
+
+	return metadata, nil
+}
+
+// plexGet requests a Plex server endpoint that the Plex API client doesn't support and decodes the JSON response into out
+func (a *Application) plexGet(ctx context.Context, path string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.config.Plex.Host+path, nil)
+	if err != nil {
+		return err
 	}
-	if metadata.Index != nil {
-		params.Metadata.EpisodeID = *metadata.Index
+
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-Plex-Token", a.config.Plex.Token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
 	}
-	if metadata.Year != nil {
-		params.Metadata.Year = *metadata.Year
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response from Plex: %s", resp.Status)
 	}
 
-	return DoFfmpeg(params)
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// jobContext limits an encode to the configured job timeout
+func (a *Application) jobContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if a.config.Ffmpeg.Timeout > 0 {
+		return context.WithTimeout(ctx, a.config.Ffmpeg.Timeout)
+	}
+	return context.WithCancel(ctx)
 }
 
 func (a *Application) Thumb(ctx context.Context, thumb string) (io.ReadCloser, error) {
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+// EBU R128 loudness targets, the same as the loudnorm filter's defaults apart from the integrated loudness which is
+// raised to -16 LUFS, the level most streaming and social media services normalize to
+const (
+	loudnessTarget      = -16
+	loudnessTruePeak    = -1.5
+	loudnessRange       = 11
+	loudnessSampleRate  = 48000
+	audioBitrateDefault = "192k"
+)
+
+// AudioFormat is the format of an audio-only export
+type AudioFormat string
+
+const (
+	// AudioFormatNone exports a video
+	AudioFormatNone AudioFormat = ""
+	AudioFormatMP3  AudioFormat = "mp3"
+	AudioFormatM4A  AudioFormat = "m4a"
+	AudioFormatOpus AudioFormat = "opus"
+	AudioFormatWAV  AudioFormat = "wav"
+)
+
+func ParseAudioFormat(s string) (AudioFormat, error) {
+	switch AudioFormat(s) {
+	case AudioFormatNone, AudioFormatMP3, AudioFormatM4A, AudioFormatOpus, AudioFormatWAV:
+		return AudioFormat(s), nil
+	default:
+		return "", fmt.Errorf("unknown audio format %q", s)
+	}
+}
+
+// Ext is the file extension of the format, including the dot
+func (f AudioFormat) Ext() string {
+	if f == AudioFormatNone {
+		return ".mp4"
+	}
+	return "." + string(f)
+}
+
+// outputArgs are the encoder and muxer options for the format
+func (f AudioFormat) outputArgs() ffmpeg.KwArgs {
+	switch f {
+	case AudioFormatMP3:
+		// ID3v2.3 tags are more widely supported than ffmpeg's default of ID3v2.4
+		return ffmpeg.KwArgs{"acodec": "libmp3lame", "b:a": audioBitrateDefault, "f": "mp3", "id3v2_version": 3}
+	case AudioFormatM4A:
+		return ffmpeg.KwArgs{"acodec": "aac", "b:a": audioBitrateDefault, "f": "mp4", "movflags": "+faststart"}
+	case AudioFormatOpus:
+		return ffmpeg.KwArgs{"acodec": "libopus", "b:a": "128k", "f": "opus"}
+	case AudioFormatWAV:
+		return ffmpeg.KwArgs{"acodec": "pcm_s16le", "f": "wav"}
+	default:
+		return ffmpeg.KwArgs{}
+	}
+}
+
+// Downmix is the channel layout of the exported audio
+type Downmix string
+
+const (
+	// DownmixDefault keeps the source's channels, except for formats that only support stereo
+	DownmixDefault Downmix = ""
+	DownmixStereo  Downmix = "stereo"
+	DownmixMono    Downmix = "mono"
+	// DownmixKeep keeps the source's channels, e.g. 5.1 surround
+	DownmixKeep Downmix = "keep"
+)
+
+func ParseDownmix(s string) (Downmix, error) {
+	switch Downmix(s) {
+	case DownmixDefault, DownmixStereo, DownmixMono, DownmixKeep:
+		return Downmix(s), nil
+	default:
+		return "", fmt.Errorf("unknown downmix %q", s)
+	}
+}
+
+// Audio changes the loudness and channels of a clip's audio, or exports only the audio
+type Audio struct {
+	// Normalize adjusts the loudness to the EBU R128 target
+	Normalize bool
+	// Loudness is the measured loudness of the clip, which makes normalization linear rather than dynamic.
+	// If it's nil when normalizing, loudnorm does a single dynamic pass.
+	Loudness *Loudness
+	Downmix  Downmix
+	Format   AudioFormat
+}
+
+func (a Audio) IsZero() bool {
+	return !a.Normalize && a.Downmix == DownmixDefault && a.Format == AudioFormatNone
+}
+
+// AudioOnly reports whether only the audio is exported
+func (a Audio) AudioOnly() bool {
+	return a.Format != AudioFormatNone
+}
+
+func (a Audio) Validate() error {
+	if a.Format == AudioFormatMP3 && a.Downmix == DownmixKeep {
+		return fmt.Errorf("mp3 only supports mono and stereo audio")
+	}
+	return nil
+}
+
+// Filters returns the audio filters that downmix and normalize the audio
+func (a Audio) Filters() []string {
+	var filters []string
+
+	// Downmixing happens before normalization so that the loudness is measured on the channels that are exported
+	downmix := a.Downmix
+	if downmix == DownmixDefault && a.Format == AudioFormatMP3 {
+		downmix = DownmixStereo
+	}
+
+	switch downmix {
+	case DownmixStereo, DownmixMono:
+		filters = append(filters, "aformat=channel_layouts="+string(downmix))
+	default:
+	}
+
+	if a.Normalize {
+		filters = append(filters, a.Loudness.Filter())
+		// loudnorm outputs 192kHz audio
+		filters = append(filters, "aresample="+strconv.Itoa(loudnessSampleRate))
+	}
+
+	return filters
+}
+
+// Loudness is the loudness of a clip measured by loudnorm's first pass
+type Loudness struct {
+	InputI       string `json:"input_i"`
+	InputTP      string `json:"input_tp"`
+	InputLRA     string `json:"input_lra"`
+	InputThresh  string `json:"input_thresh"`
+	TargetOffset string `json:"target_offset"`
+}
+
+// Filter returns the loudnorm filter. If the loudness has been measured, the loudness is adjusted linearly so that
+// the dynamics of the clip are preserved.
+func (l *Loudness) Filter() string {
+	options := []string{
+		fmt.Sprintf("I=%v", loudnessTarget),
+		fmt.Sprintf("TP=%v", loudnessTruePeak),
+		fmt.Sprintf("LRA=%v", loudnessRange),
+	}
+
+	if l != nil {
+		options = append(options,
+			"measured_I="+l.InputI,
+			"measured_TP="+l.InputTP,
+			"measured_LRA="+l.InputLRA,
+			"measured_thresh="+l.InputThresh,
+			"offset="+l.TargetOffset,
+			"linear=true",
+		)
+	}
+
+	return "loudnorm=" + strings.Join(options, ":")
+}
+
+// MeasureLoudness runs the first pass of loudnorm over the clip's audio
+func MeasureLoudness(ctx context.Context, params FfmpegParams) (*Loudness, error) {
+	audio := params.Audio
+	audio.Normalize = false
+	filters := append(audio.Filters(), (*Loudness)(nil).Filter()+":print_format=json")
+
+	stream := ffmpeg.
+		Input(params.URL, ffmpeg.MergeKwArgs([]ffmpeg.KwArgs{params.Input().InputArgs(params.From, params.To), {
+			"hide_banner": "",
+			// loudnorm prints its measurements at the info level
+			"loglevel": "info",
+			"nostats":  "",
+		}})).
+		Output("-", ffmpeg.KwArgs{
+			"af": strings.Join(filters, ","),
+			"vn": "",
+			"sn": "",
+			"f":  "null",
+		})
+
+	stderr, err := runFfmpegStderr(ctx, stream.GetArgs(), nil, "", params.Input().Pipes()...)
+	if err != nil {
+		return nil, fmt.Errorf("could not measure loudness: %w", err)
+	}
+
+	// The measurements are printed as a JSON object at the end of the output
+	start := strings.LastIndex(stderr, "{")
+	end := strings.LastIndex(stderr, "}")
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("could not measure loudness: no measurements in output")
+	}
+
+	var loudness Loudness
+	if err := json.Unmarshal([]byte(stderr[start:end+1]), &loudness); err != nil {
+		return nil, fmt.Errorf("could not parse loudness measurements: %w", err)
+	}
+
+	// Silent clips measure as -inf, which loudnorm won't accept, so they're left for the dynamic mode to handle
+	if _, err := strconv.ParseFloat(loudness.InputI, 64); err != nil || strings.Contains(loudness.InputI, "inf") {
+		return nil, nil
+	}
+
+	return &loudness, nil
+}
+
+// AudioArgs returns the -metadata arguments for audio-only exports, which add the tags that music players show
+func (m FfmpegParamsMetadata) AudioArgs(from, to string) []string {
+	tags := map[string]string{
+		"title":   m.Title,
+		"comment": from + "-" + to,
+		"artist":  m.Title,
+		"album":   m.Title,
+	}
+
+	switch {
+	case m.Show != "":
+		tags["artist"] = m.Show
+		tags["album"] = fmt.Sprintf("%s Season %d", m.Show, m.SeasonNumber)
+		tags["track"] = strconv.Itoa(m.EpisodeID)
+	case m.Artist != "":
+		tags["artist"] = m.Artist
+		if m.Album != "" {
+			tags["album"] = m.Album
+			tags["album_artist"] = m.Artist
+		}
+		if m.TrackNumber != 0 {
+			tags["track"] = strconv.Itoa(m.TrackNumber)
+		}
+		if m.DiscNumber != 0 {
+			tags["disc"] = strconv.Itoa(m.DiscNumber)
+		}
+	}
+	if m.Year != 0 {
+		tags["date"] = strconv.Itoa(m.Year)
+	}
+	if m.ReleaseDate != "" {
+		tags["date"] = m.ReleaseDate
+	}
+	if len(m.Genres) > 0 {
+		tags["genre"] = strings.Join(m.Genres, ", ")
+	}
+
+	var args []string
+	for k, v := range tags {
+		args = append(args, fmt.Sprintf("%s=%s", k, v))
+	}
+	sort.Strings(args)
+
+	return args
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	bifMagic = []byte{0x89, 'B', 'I', 'F', '\r', '\n', 0x1a, '\n'}
+
+	ErrNoBIF = errors.New("media has no index thumbnails")
+)
+
+// bifCacheSize is the number of parts whose index thumbnails are kept in memory
+const bifCacheSize = 8
+
+// BIF holds the index thumbnails Plex generates for seeking, stored in the Roku "Base Index Frames" format.
+// https://developer.roku.com/docs/developer-program/media-playback/trick-mode/bif-file-creation.md
+type BIF struct {
+	Frames []BIFFrame
+}
+
+type BIFFrame struct {
+	Timestamp time.Duration
+	// Image is a JPEG
+	Image []byte
+}
+
+func ParseBIF(data []byte) (*BIF, error) {
+	if len(data) < 64 || !bytes.Equal(data[:8], bifMagic) {
+		return nil, fmt.Errorf("not a BIF file")
+	}
+
+	count := int(binary.LittleEndian.Uint32(data[12:16]))
+	if count == 0 {
+		return nil, ErrNoBIF
+	}
+
+	interval := time.Duration(binary.LittleEndian.Uint32(data[16:20])) * time.Millisecond
+	if interval == 0 {
+		interval = time.Second
+	}
+
+	// The index has an entry for each frame plus a terminating entry that marks the end of the last frame
+	if len(data) < 64+(count+1)*8 {
+		return nil, fmt.Errorf("BIF index is truncated")
+	}
+
+	bif := &BIF{}
+	for i := 0; i < count; i++ {
+		entry := data[64+i*8:]
+		timestamp := binary.LittleEndian.Uint32(entry[0:4])
+		start := binary.LittleEndian.Uint32(entry[4:8])
+		end := binary.LittleEndian.Uint32(entry[12:16])
+
+		if start > end || int(end) > len(data) {
+			return nil, fmt.Errorf("BIF frame %d is out of bounds", i)
+		}
+
+		bif.Frames = append(bif.Frames, BIFFrame{
+			Timestamp: time.Duration(timestamp) * interval,
+			Image:     data[start:end],
+		})
+	}
+
+	return bif, nil
+}
+
+// FrameAt returns the frame closest to the timestamp
+func (b *BIF) FrameAt(t time.Duration) BIFFrame {
+	i := sort.Search(len(b.Frames), func(i int) bool {
+		return b.Frames[i].Timestamp >= t
+	})
+
+	if i == len(b.Frames) {
+		return b.Frames[len(b.Frames)-1]
+	}
+	if i > 0 && t-b.Frames[i-1].Timestamp < b.Frames[i].Timestamp-t {
+		return b.Frames[i-1]
+	}
+	return b.Frames[i]
+}
+
+// BIFCache keeps the most recently used index thumbnails in memory
+type BIFCache struct {
+	mu      sync.Mutex
+	entries map[int]*bifCacheEntry
+}
+
+type bifCacheEntry struct {
+	// done is closed once the index thumbnails have been fetched
+	done     chan struct{}
+	bif      *BIF
+	err      error
+	lastUsed time.Time
+}
+
+func NewBIFCache() *BIFCache {
+	return &BIFCache{
+		entries: map[int]*bifCacheEntry{},
+	}
+}
+
+// Get returns the cached index thumbnails for the part, calling fetch to load them if they aren't cached.
+// Parts without index thumbnails are cached too so that Plex isn't asked for them again.
+// The fetch happens outside of the lock so that a slow download only holds up requests for the same part, which stop
+// waiting for it when their context is done.
+func (c *BIFCache) Get(ctx context.Context, partID int, fetch func() (*BIF, error)) (*BIF, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[partID]
+	if ok {
+		entry.lastUsed = time.Now()
+		c.mu.Unlock()
+		select {
+		case <-entry.done:
+			return entry.bif, entry.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	entry = &bifCacheEntry{done: make(chan struct{}), lastUsed: time.Now()}
+	c.entries[partID] = entry
+	if len(c.entries) > bifCacheSize {
+		c.evictOldest()
+	}
+	c.mu.Unlock()
+
+	entry.bif, entry.err = fetch()
+
+	if entry.err != nil && !errors.Is(entry.err, ErrNoBIF) {
+		// Allow the fetch to be retried
+		c.mu.Lock()
+		if c.entries[partID] == entry {
+			delete(c.entries, partID)
+		}
+		c.mu.Unlock()
+	}
+
+	close(entry.done)
+
+	return entry.bif, entry.err
+}
+
+func (c *BIFCache) evictOldest() {
+	oldest := -1
+	for partID, entry := range c.entries {
+		if oldest == -1 || entry.lastUsed.Before(c.entries[oldest].lastUsed) {
+			oldest = partID
+		}
+	}
+	delete(c.entries, oldest)
+}
+
+// BIF returns the index thumbnails Plex has generated for the part, or ErrNoBIF if there aren't any
+func (a *Application) BIF(ctx context.Context, partID int) (*BIF, error) {
+	return a.bifs.Get(ctx, partID, func() (*BIF, error) {
+		url := fmt.Sprintf("%s/library/parts/%d/indexes/sd", a.config.Plex.Host, partID)
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		// The token is sent as a header so that it isn't included in errors, which contain the URL
+		req.Header.Set("X-Plex-Token", a.config.Plex.Token)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("could not get index thumbnails: %w", err)
+		}
+
+		defer resp.Body.Close()
+
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, ErrNoBIF
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("could not get index thumbnails: %s", resp.Status)
+		}
+
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("could not read index thumbnails: %w", err)
+		}
+
+		return ParseBIF(data)
+	})
+}
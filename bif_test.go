@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBIFCacheGetWaitCanceled(t *testing.T) {
+	c := NewBIFCache()
+
+	started, release := make(chan struct{}), make(chan struct{})
+	fetched := make(chan error)
+	go func() {
+		_, err := c.Get(context.Background(), 1, func() (*BIF, error) {
+			close(started)
+			<-release
+			return nil, ErrNoBIF
+		})
+		fetched <- err
+	}()
+	<-started
+
+	// A second request for the part waits for the first fetch, but gives up when its context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.Get(ctx, 1, func() (*BIF, error) {
+		t.Error("index thumbnails were fetched twice")
+		return nil, nil
+	}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Get returned %v, want %v", err, context.Canceled)
+	}
+
+	close(release)
+	if err := <-fetched; !errors.Is(err, ErrNoBIF) {
+		t.Errorf("first fetch returned %v, want %v", err, ErrNoBIF)
+	}
+}
+
+// testBIF returns a BIF file with the images, one every interval milliseconds
+func testBIF(interval uint32, images ...string) []byte {
+	data := make([]byte, 64+(len(images)+1)*8)
+	copy(data, bifMagic)
+	binary.LittleEndian.PutUint32(data[12:], uint32(len(images)))
+	binary.LittleEndian.PutUint32(data[16:], interval)
+
+	for i, image := range images {
+		entry := data[64+i*8:]
+		binary.LittleEndian.PutUint32(entry, uint32(i))
+		binary.LittleEndian.PutUint32(entry[4:], uint32(len(data)))
+		data = append(data, image...)
+	}
+
+	// The terminating entry marks the end of the last image
+	end := data[64+len(images)*8:]
+	binary.LittleEndian.PutUint32(end, 0xffffffff)
+	binary.LittleEndian.PutUint32(end[4:], uint32(len(data)))
+
+	return data
+}
+
+func TestParseBIF(t *testing.T) {
+	outOfBounds := testBIF(1000, "first", "second")
+	binary.LittleEndian.PutUint32(outOfBounds[64+2*8+4:], uint32(len(outOfBounds)+1))
+
+	reversed := testBIF(1000, "first", "second")
+	binary.LittleEndian.PutUint32(reversed[64+4:], uint32(len(reversed)))
+
+	tests := []struct {
+		name    string
+		data    []byte
+		want    []BIFFrame
+		wantErr error
+	}{
+		{
+			name: "frames",
+			data: testBIF(2000, "first", "second"),
+			want: []BIFFrame{
+				{Timestamp: 0, Image: []byte("first")},
+				{Timestamp: 2 * time.Second, Image: []byte("second")},
+			},
+		},
+		{
+			name: "default interval",
+			data: testBIF(0, "first", "second"),
+			want: []BIFFrame{
+				{Timestamp: 0, Image: []byte("first")},
+				{Timestamp: time.Second, Image: []byte("second")},
+			},
+		},
+		{name: "no frames", data: testBIF(1000), wantErr: ErrNoBIF},
+		{name: "not a BIF", data: append([]byte("GIF89a"), make([]byte, 100)...)},
+		{name: "short header", data: testBIF(1000, "first")[:32]},
+		{name: "truncated index", data: testBIF(1000, "first", "second")[:64+2*8]},
+		{name: "frame out of bounds", data: outOfBounds},
+		{name: "frame ends before it starts", data: reversed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseBIF(tt.data)
+			if tt.want == nil {
+				if err == nil {
+					t.Fatalf("ParseBIF() = %+v, want an error", got)
+				}
+				if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+					t.Errorf("ParseBIF() returned %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseBIF() returned an error: %v", err)
+			}
+			if !reflect.DeepEqual(got.Frames, tt.want) {
+				t.Errorf("ParseBIF() = %+v, want %+v", got.Frames, tt.want)
+			}
+		})
+	}
+}
+
+func TestBIFFrameAt(t *testing.T) {
+	bif := &BIF{Frames: []BIFFrame{
+		{Timestamp: 0, Image: []byte("0")},
+		{Timestamp: 10 * time.Second, Image: []byte("10")},
+		{Timestamp: 20 * time.Second, Image: []byte("20")},
+	}}
+
+	tests := []struct {
+		at   time.Duration
+		want string
+	}{
+		{at: 0, want: "0"},
+		{at: 4 * time.Second, want: "0"},
+		{at: 6 * time.Second, want: "10"},
+		{at: 10 * time.Second, want: "10"},
+		{at: time.Hour, want: "20"},
+	}
+
+	for _, tt := range tests {
+		if got := bif.FrameAt(tt.at); string(got.Image) != tt.want {
+			t.Errorf("FrameAt(%v) = frame %s, want frame %s", tt.at, got.Image, tt.want)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const probeTimeout = 30 * time.Second
+
+// Capabilities describes what the local ffmpeg build and hardware are able to do
+type Capabilities struct {
+	HWAccels []string                  `json:"hwaccels"`
+	Codecs   map[Codec]CodecCapability `json:"codecs"`
+}
+
+type CodecCapability struct {
+	// Available is true when the encoder is included in the ffmpeg build
+	Available bool `json:"available"`
+	// Working is true when a test encode succeeded
+	Working bool   `json:"working"`
+	Error   string `json:"error,omitempty"`
+}
+
+// ProbeCapabilities checks which hardware acceleration methods and encoders are usable by running a tiny test
+// encode with each supported codec that's included in the ffmpeg build, on each device configured for the codec.
+func ProbeCapabilities(devices *DevicePool) *Capabilities {
+	caps := &Capabilities{
+		HWAccels: ffmpegHWAccels(),
+		Codecs:   map[Codec]CodecCapability{},
+	}
+
+	for _, codec := range codecs {
+		var capability CodecCapability
+		capability.Available = ffmpegHasEncoder(string(codec))
+		if capability.Available {
+			codecDevices := devices.Devices(codec)
+			if len(codecDevices) == 0 {
+				// Software codecs don't use a device
+				codecDevices = []string{""}
+			}
+
+			capability.Working = true
+			for _, device := range codecDevices {
+				if err := testEncode(codec, device); err != nil {
+					capability.Working = false
+					capability.Error = strings.TrimSpace(device + " " + err.Error())
+					break
+				}
+			}
+		}
+		caps.Codecs[codec] = capability
+	}
+
+	return caps
+}
+
+// IsWorking reports whether the codec passed its test encode
+func (c *Capabilities) IsWorking(codec Codec) bool {
+	return c.Codecs[codec].Working
+}
+
+// Usable returns the codec if it's working, otherwise the software encoder that's used as a fallback
+func (c *Capabilities) Usable(codec Codec) Codec {
+	if c.IsWorking(codec) {
+		return codec
+	}
+	return codec.Software()
+}
+
+// Log reports the probe results for each codec
+func (c *Capabilities) Log() {
+	log.Printf("ffmpeg hwaccels: %s", strings.Join(c.HWAccels, ", "))
+
+	for _, codec := range codecs {
+		capability := c.Codecs[codec]
+		switch {
+		case capability.Working:
+			log.Printf("codec %s: working", codec)
+		case capability.Available:
+			log.Printf("codec %s: test encode failed: %s", codec, capability.Error)
+		default:
+			log.Printf("codec %s: not included in ffmpeg build", codec)
+		}
+	}
+}
+
+func ffmpegHWAccels() []string {
+	out, err := exec.Command("ffmpeg", "-hide_banner", "-hwaccels").Output()
+	if err != nil {
+		return nil
+	}
+
+	var hwAccels []string
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		// The first line is a "Hardware acceleration methods:" header
+		if line == "" || strings.HasSuffix(line, ":") {
+			continue
+		}
+		hwAccels = append(hwAccels, line)
+	}
+
+	return hwAccels
+}
+
+// testEncode encodes a fraction of a second of a generated test pattern, discarding the result
+func testEncode(codec Codec, device string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+
+	args := []string{"-hide_banner", "-loglevel", "error"}
+	filter := "format=nv12"
+
+	// NVENC and QSV accept frames from system memory, but VAAPI encoders need the frames uploaded to the GPU
+	switch codec.HWAccel() {
+	case HWAccelVAAPI:
+		args = append(args, "-init_hw_device", "vaapi=va:"+device, "-filter_hw_device", "va")
+		filter += ",hwupload"
+	case HWAccelQSV:
+		args = append(args, "-init_hw_device", "qsv=qs:hw_any,child_device="+device)
+	default:
+	}
+
+	args = append(args,
+		"-f", "lavfi",
+		"-i", "testsrc2=size=320x240:rate=10:duration=0.5",
+		"-vf", filter,
+		"-c:v", string(codec),
+	)
+
+	if codec.HWAccel() == HWAccelCUDA {
+		args = append(args, "-gpu", device)
+	}
+
+	args = append(args,
+		"-f", "null",
+		"-",
+	)
+
+	stderr := &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	cmd.Stderr = stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Chapter is a chapter of a media item, as listed in the file or looked up by Plex
+type Chapter struct {
+	// Index starts at 1
+	Index int
+	Title string
+	Start time.Duration
+	End   time.Duration
+}
+
+// Marker is a section of a media item that Plex has detected, such as the intro or credits
+type Marker struct {
+	Type  MarkerType
+	Start time.Duration
+	End   time.Duration
+	// Final is true for the credits marker that runs to the end of the media
+	Final bool
+}
+
+type MarkerType string
+
+const (
+	MarkerTypeIntro   MarkerType = "intro"
+	MarkerTypeCredits MarkerType = "credits"
+)
+
+// MarkerMode determines how a clip's range is adjusted around a marker
+type MarkerMode string
+
+const (
+	// MarkerModeNone leaves the range alone
+	MarkerModeNone MarkerMode = ""
+	// MarkerModeSkip trims the marker off the range. Intros are trimmed off the start and credits off the end.
+	MarkerModeSkip MarkerMode = "skip"
+	// MarkerModeOnly replaces the range with the marker
+	MarkerModeOnly MarkerMode = "only"
+)
+
+func ParseMarkerMode(s string) (MarkerMode, error) {
+	switch MarkerMode(s) {
+	case MarkerModeNone, MarkerModeSkip, MarkerModeOnly:
+		return MarkerMode(s), nil
+	default:
+		return "", fmt.Errorf("unknown marker mode %q", s)
+	}
+}
+
+// MediaChapters are the chapters and markers of a media item
+type MediaChapters struct {
+	Chapters []Chapter
+	Markers  []Marker
+}
+
+type plexChaptersResponse struct {
+	MediaContainer struct {
+		Metadata []struct {
+			Chapter []struct {
+				Index           int    `json:"index"`
+				Tag             string `json:"tag"`
+				StartTimeOffset int    `json:"startTimeOffset"`
+				EndTimeOffset   int    `json:"endTimeOffset"`
+			} `json:"Chapter"`
+			Marker []struct {
+				Type            string `json:"type"`
+				StartTimeOffset int    `json:"startTimeOffset"`
+				EndTimeOffset   int    `json:"endTimeOffset"`
+				Final           bool   `json:"final"`
+			} `json:"Marker"`
+		} `json:"Metadata"`
+	} `json:"MediaContainer"`
+}
+
+// Chapters looks up the chapters and markers of the rating key's media.
+// The Plex API client doesn't include chapters or markers in its metadata so they're requested separately.
+func (a *Application) Chapters(ctx context.Context, ratingKeyStr string) (*MediaChapters, error) {
+	if _, err := strconv.Atoi(ratingKeyStr); err != nil {
+		return nil, fmt.Errorf("could not parse rating key: %w", err)
+	}
+
+	var body plexChaptersResponse
+	if err := a.plexGet(ctx, "/library/metadata/"+ratingKeyStr+"?includeChapters=1&includeMarkers=1", &body); err != nil {
+		return nil, fmt.Errorf("could not get chapters: %w", err)
+	}
+
+	if len(body.MediaContainer.Metadata) == 0 {
+		return nil, fmt.Errorf("could not find metadata for rating key")
+	}
+
+	metadata := body.MediaContainer.Metadata[0]
+	chapters := &MediaChapters{}
+
+	for _, c := range metadata.Chapter {
+		chapters.Chapters = append(chapters.Chapters, Chapter{
+			Index: c.Index,
+			Title: c.Tag,
+			Start: time.Duration(c.StartTimeOffset) * time.Millisecond,
+			End:   time.Duration(c.EndTimeOffset) * time.Millisecond,
+		})
+	}
+
+	for _, m := range metadata.Marker {
+		chapters.Markers = append(chapters.Markers, Marker{
+			Type:  MarkerType(m.Type),
+			Start: time.Duration(m.StartTimeOffset) * time.Millisecond,
+			End:   time.Duration(m.EndTimeOffset) * time.Millisecond,
+			Final: m.Final,
+		})
+	}
+
+	return chapters, nil
+}
+
+// Chapter finds a chapter by its index, or failing that, its title
+func (c *MediaChapters) Chapter(indexOrTitle string) (*Chapter, error) {
+	if index, err := strconv.Atoi(indexOrTitle); err == nil {
+		for i := range c.Chapters {
+			if c.Chapters[i].Index == index {
+				return &c.Chapters[i], nil
+			}
+		}
+		return nil, fmt.Errorf("chapter %d not found", index)
+	}
+
+	for i := range c.Chapters {
+		if strings.EqualFold(c.Chapters[i].Title, indexOrTitle) {
+			return &c.Chapters[i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("chapter %q not found", indexOrTitle)
+}
+
+// markerRange returns the start of the first marker of the type and the end of the last one, since credits can be
+// split by a mid-credits scene
+func (c *MediaChapters) markerRange(markerType MarkerType) (start, end time.Duration, ok bool) {
+	for _, m := range c.Markers {
+		if m.Type != markerType {
+			continue
+		}
+		if !ok || m.Start < start {
+			start = m.Start
+		}
+		if !ok || m.End > end {
+			end = m.End
+		}
+		ok = true
+	}
+
+	return start, end, ok
+}
+
+// ApplyMarkers adjusts the from-to range around the intro and credits markers
+func (c *MediaChapters) ApplyMarkers(from, to time.Duration, intro, credits MarkerMode) (time.Duration, time.Duration, error) {
+	if intro != MarkerModeNone {
+		start, end, ok := c.markerRange(MarkerTypeIntro)
+		if !ok {
+			return 0, 0, fmt.Errorf("media has no intro marker")
+		}
+
+		switch intro {
+		case MarkerModeSkip:
+			// Only ranges that overlap the intro are affected, so a cold open before the intro can still be clipped
+			if from < end && to > start {
+				from = end
+			}
+		case MarkerModeOnly:
+			from, to = start, end
+		default:
+		}
+	}
+
+	if credits != MarkerModeNone {
+		start, end, ok := c.markerRange(MarkerTypeCredits)
+		if !ok {
+			return 0, 0, fmt.Errorf("media has no credits marker")
+		}
+
+		switch credits {
+		case MarkerModeSkip:
+			if from < end && to > start {
+				to = start
+			}
+		case MarkerModeOnly:
+			from, to = start, end
+		default:
+		}
+	}
+
+	if from >= to {
+		return 0, 0, fmt.Errorf("clip is empty once the markers are applied")
+	}
+
+	return from, to, nil
+}
+
+// ClipRange resolves the range to clip from the user's timestamps or chapter, adjusted for the markers.
+// If chapter is set, from and to are ignored.
+func (a *Application) ClipRange(ctx context.Context, ratingKeyStr, from, to, chapter string, intro, credits MarkerMode) (string, string, error) {
+	if chapter == "" && intro == MarkerModeNone && credits == MarkerModeNone {
+		return from, to, nil
+	}
+
+	chapters, err := a.Chapters(ctx, ratingKeyStr)
+	if err != nil {
+		return "", "", err
+	}
+
+	var fromTime, toTime time.Duration
+	if chapter != "" {
+		c, err := chapters.Chapter(chapter)
+		if err != nil {
+			return "", "", err
+		}
+		fromTime, toTime = c.Start, c.End
+	} else {
+		fromTime, err = ParseTimestamp(from)
+		if err != nil {
+			return "", "", err
+		}
+		toTime, err = ParseTimestamp(to)
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	fromTime, toTime, err = chapters.ApplyMarkers(fromTime, toTime, intro, credits)
+	if err != nil {
+		return "", "", err
+	}
+
+	return FormatTimestamp(fromTime), FormatTimestamp(toTime), nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestApplyMarkers(t *testing.T) {
+	m := time.Minute
+	chapters := &MediaChapters{Markers: []Marker{
+		{Type: MarkerTypeIntro, Start: 2 * m, End: 3 * m},
+		// Credits split by a mid-credits scene
+		{Type: MarkerTypeCredits, Start: 40 * m, End: 42 * m},
+		{Type: MarkerTypeCredits, Start: 43 * m, End: 45 * m, Final: true},
+	}}
+
+	tests := []struct {
+		name     string
+		chapters *MediaChapters
+		from, to time.Duration
+		intro    MarkerMode
+		credits  MarkerMode
+		wantFrom time.Duration
+		wantTo   time.Duration
+		wantErr  bool
+	}{
+		{name: "no markers", chapters: chapters, from: m, to: 10 * m, wantFrom: m, wantTo: 10 * m},
+		{name: "skip intro", chapters: chapters, from: 0, to: 10 * m, intro: MarkerModeSkip, wantFrom: 3 * m, wantTo: 10 * m},
+		{name: "skip intro before it", chapters: chapters, from: 0, to: m, intro: MarkerModeSkip, wantFrom: 0, wantTo: m},
+		{name: "skip intro after it", chapters: chapters, from: 5 * m, to: 10 * m, intro: MarkerModeSkip, wantFrom: 5 * m, wantTo: 10 * m},
+		{name: "only intro", chapters: chapters, from: 0, to: 45 * m, intro: MarkerModeOnly, wantFrom: 2 * m, wantTo: 3 * m},
+		{name: "skip credits", chapters: chapters, from: 30 * m, to: 45 * m, credits: MarkerModeSkip, wantFrom: 30 * m, wantTo: 40 * m},
+		{name: "only credits", chapters: chapters, from: 0, to: m, credits: MarkerModeOnly, wantFrom: 40 * m, wantTo: 45 * m},
+		{name: "skip both", chapters: chapters, from: 0, to: 45 * m, intro: MarkerModeSkip, credits: MarkerModeSkip, wantFrom: 3 * m, wantTo: 40 * m},
+		{name: "intro inside the range", chapters: chapters, from: 2*m + 30*time.Second, to: 2*m + 40*time.Second, intro: MarkerModeSkip, wantErr: true},
+		{name: "only the intro then skip credits", chapters: chapters, from: 0, to: 45 * m, intro: MarkerModeOnly, credits: MarkerModeSkip, wantFrom: 2 * m, wantTo: 3 * m},
+		{name: "missing intro", chapters: &MediaChapters{}, from: 0, to: m, intro: MarkerModeSkip, wantErr: true},
+		{name: "missing credits", chapters: &MediaChapters{}, from: 0, to: m, credits: MarkerModeOnly, wantErr: true},
+		{name: "empty once applied", chapters: chapters, from: 40 * m, to: 45 * m, credits: MarkerModeSkip, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from, to, err := tt.chapters.ApplyMarkers(tt.from, tt.to, tt.intro, tt.credits)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ApplyMarkers() = %v-%v, want an error", from, to)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ApplyMarkers() returned an error: %v", err)
+			}
+			if from != tt.wantFrom || to != tt.wantTo {
+				t.Errorf("ApplyMarkers() = %v-%v, want %v-%v", from, to, tt.wantFrom, tt.wantTo)
+			}
+		})
+	}
+}
+
+func TestChapter(t *testing.T) {
+	chapters := &MediaChapters{Chapters: []Chapter{
+		{Index: 1, Title: "Opening", Start: 0, End: time.Minute},
+		{Index: 2, Title: "The Heist", Start: time.Minute, End: 10 * time.Minute},
+	}}
+
+	tests := []struct {
+		in        string
+		wantIndex int
+		wantErr   bool
+	}{
+		{in: "2", wantIndex: 2},
+		{in: "the heist", wantIndex: 2},
+		{in: "Opening", wantIndex: 1},
+		{in: "3", wantErr: true},
+		{in: "Closing", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := chapters.Chapter(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("Chapter(%q) = %+v, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Chapter(%q) returned an error: %v", tt.in, err)
+			continue
+		}
+		if got.Index != tt.wantIndex {
+			t.Errorf("Chapter(%q) = chapter %d, want chapter %d", tt.in, got.Index, tt.wantIndex)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+type Codec string
+
+const (
+	CodecH264VAAPI Codec = "h264_vaapi"
+	CodecH264NVENC Codec = "h264_nvenc"
+	CodecH264QSV   Codec = "h264_qsv"
+	CodecLibx264   Codec = "libx264"
+
+	CodecHEVCVAAPI Codec = "hevc_vaapi"
+	CodecHEVCNVENC Codec = "hevc_nvenc"
+	CodecHEVCQSV   Codec = "hevc_qsv"
+	CodecLibx265   Codec = "libx265"
+
+	CodecAV1VAAPI Codec = "av1_vaapi"
+	CodecAV1NVENC Codec = "av1_nvenc"
+)
+
+var codecs = []Codec{
+	CodecH264VAAPI, CodecH264NVENC, CodecH264QSV, CodecLibx264,
+	CodecHEVCVAAPI, CodecHEVCNVENC, CodecHEVCQSV, CodecLibx265,
+	CodecAV1VAAPI, CodecAV1NVENC,
+}
+
+// HWAccel is the ffmpeg hardware acceleration method used to decode and filter frames for an encoder
+type HWAccel string
+
+const (
+	HWAccelNone  HWAccel = ""
+	HWAccelVAAPI HWAccel = "vaapi"
+	HWAccelCUDA  HWAccel = "cuda"
+	HWAccelQSV   HWAccel = "qsv"
+)
+
+// ParseCodec validates that the codec is supported by CutScene
+func ParseCodec(s string) (Codec, error) {
+	for _, codec := range codecs {
+		if string(codec) == s {
+			return codec, nil
+		}
+	}
+
+	return "", fmt.Errorf("unknown codec %q", s)
+}
+
+// ParseAvailableCodec validates that the codec is supported by CutScene and by the local ffmpeg build
+func ParseAvailableCodec(s string) (Codec, error) {
+	codec, err := ParseCodec(s)
+	if err != nil {
+		return "", err
+	}
+
+	if !ffmpegHasEncoder(s) {
+		return "", fmt.Errorf("codec %q is not supported by the installed ffmpeg", s)
+	}
+
+	return codec, nil
+}
+
+func (c Codec) HWAccel() HWAccel {
+	switch {
+	case strings.HasSuffix(string(c), "_vaapi"):
+		return HWAccelVAAPI
+	case strings.HasSuffix(string(c), "_nvenc"):
+		return HWAccelCUDA
+	case strings.HasSuffix(string(c), "_qsv"):
+		return HWAccelQSV
+	default:
+		return HWAccelNone
+	}
+}
+
+func (c Codec) IsHEVC() bool {
+	return c == CodecLibx265 || strings.HasPrefix(string(c), "hevc_")
+}
+
+func (c Codec) IsAV1() bool {
+	return strings.HasPrefix(string(c), "av1_")
+}
+
+// Supports10Bit reports whether the codec can encode 10-bit color (HEVC Main 10 or AV1 Main)
+func (c Codec) Supports10Bit() bool {
+	return c.IsHEVC() || c.IsAV1()
+}
+
+// H264 returns the H.264 encoder using the same hardware acceleration as the codec
+func (c Codec) H264() Codec {
+	switch c.HWAccel() {
+	case HWAccelVAAPI:
+		return CodecH264VAAPI
+	case HWAccelCUDA:
+		return CodecH264NVENC
+	case HWAccelQSV:
+		return CodecH264QSV
+	default:
+		return CodecLibx264
+	}
+}
+
+// HEVC returns the HEVC encoder using the same hardware acceleration as the codec
+func (c Codec) HEVC() Codec {
+	switch c.HWAccel() {
+	case HWAccelVAAPI:
+		return CodecHEVCVAAPI
+	case HWAccelCUDA:
+		return CodecHEVCNVENC
+	case HWAccelQSV:
+		return CodecHEVCQSV
+	default:
+		return CodecLibx265
+	}
+}
+
+// Software returns the software encoder used as a fallback when the codec's hardware isn't working
+func (c Codec) Software() Codec {
+	if c.IsHEVC() {
+		return CodecLibx265
+	}
+	return CodecLibx264
+}
+
+// QP converts a quantization parameter on the H.264/HEVC scale (0-51) to the scale used by the codec
+func (c Codec) QP(qp int) int {
+	if c.IsAV1() {
+		// AV1 encoders use a 0-255 quantizer range
+		return qp * 5
+	}
+	return qp
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/LukeHagar/plexgo/models/operations"
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+const (
+	compilationMaxSegments     = 50
+	compilationDefaultHeight   = 1080
+	compilationDefaultFPS      = 24
+	compilationSampleRate      = 48000
+	compilationDefaultTitle    = "Compilation"
+	compilationMaxCrossfade    = 5 * time.Second
+	compilationChapterTimebase = time.Millisecond
+)
+
+// plexStreamTypeAudio is the Plex stream type of audio streams
+const plexStreamTypeAudio = 2
+
+// CompilationSegment is a range of a media item to include in a compilation
+type CompilationSegment struct {
+	RatingKey string `json:"ratingKey"`
+	MediaID   string `json:"mediaId"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+}
+
+// CompilationOptions are the user-provided options that modify the resulting compilation
+type CompilationOptions struct {
+	Title string
+	// Crossfade is the length of the transition between segments, segments are cut together if it's 0
+	Crossfade time.Duration
+	Codec     Codec
+	Height    int
+	QP        int
+}
+
+// Compilation stitches segments from one or more media items into a single file.
+// Segments are decoded and normalized in software since they can differ in resolution, frame rate, bit depth and
+// audio layout, and all of them have to match for the concat and xfade filters.
+type Compilation struct {
+	Segments  []compilationSegment
+	Title     string
+	Width     int
+	Height    int
+	FPS       float64
+	Crossfade time.Duration
+	Codec     Codec
+	QP        int
+	Device    string
+}
+
+type compilationSegment struct {
+	Input  PartInput
+	Source VideoSource
+	// HasAudio is false for videos without an audio stream, silence is generated for them instead
+	HasAudio bool
+	From     time.Duration
+	To       time.Duration
+	Metadata FfmpegParamsMetadata
+}
+
+func (s compilationSegment) Duration() time.Duration {
+	return s.To - s.From
+}
+
+// Starts returns the time each segment starts at in the output, taking the overlap of crossfades into account
+func (c *Compilation) Starts() []time.Duration {
+	starts := make([]time.Duration, len(c.Segments))
+	for i := 1; i < len(c.Segments); i++ {
+		starts[i] = starts[i-1] + c.Segments[i-1].Duration() - c.Crossfade
+	}
+	return starts
+}
+
+// FilterGraph normalizes each segment and joins them into the [v] and [a] outputs. The joined video goes through the
+// upload filter, if there is one, to get it to the encoder.
+func (c *Compilation) FilterGraph(upload string) string {
+	var graph []string
+
+	for i, segment := range c.Segments {
+		var video []string
+		if segment.Source.Is10Bit() {
+			video = append(video, tonemapSoftware(segment.Source))
+		}
+		video = append(video,
+			fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=decrease", c.Width, c.Height),
+			fmt.Sprintf("pad=%d:%d:-1:-1", c.Width, c.Height),
+			"setsar=1",
+			"fps="+strconv.FormatFloat(c.FPS, 'f', -1, 64),
+			"format=yuv420p",
+			"setpts=PTS-STARTPTS",
+			"settb=AVTB",
+		)
+		graph = append(graph, fmt.Sprintf("[%d:v:0]%s[v%d]", i, strings.Join(video, ","), i))
+
+		audio := []string{
+			fmt.Sprintf("aresample=%d", compilationSampleRate),
+			"aformat=sample_fmts=fltp:channel_layouts=stereo",
+			"asetpts=PTS-STARTPTS",
+		}
+		if segment.HasAudio {
+			graph = append(graph, fmt.Sprintf("[%d:a:0]%s[a%d]", i, strings.Join(audio, ","), i))
+		} else {
+			// The concat and acrossfade filters need audio from every segment
+			graph = append(graph, fmt.Sprintf("anullsrc=r=%d:cl=stereo,atrim=duration=%.3f,%s[a%d]",
+				compilationSampleRate, segment.Duration().Seconds(), strings.Join(audio, ","), i))
+		}
+	}
+
+	videoOut := "[v]"
+	if upload != "" {
+		videoOut = "[vj]"
+	}
+
+	if c.Crossfade > 0 && len(c.Segments) > 1 {
+		starts := c.Starts()
+		video, audio := "[v0]", "[a0]"
+		for i := 1; i < len(c.Segments); i++ {
+			nextVideo, nextAudio := fmt.Sprintf("[vx%d]", i), fmt.Sprintf("[ax%d]", i)
+			if i == len(c.Segments)-1 {
+				nextVideo, nextAudio = videoOut, "[a]"
+			}
+			graph = append(graph,
+				fmt.Sprintf("%s[v%d]xfade=transition=fade:duration=%.3f:offset=%.3f%s",
+					video, i, c.Crossfade.Seconds(), starts[i].Seconds(), nextVideo),
+				fmt.Sprintf("%s[a%d]acrossfade=d=%.3f%s", audio, i, c.Crossfade.Seconds(), nextAudio),
+			)
+			video, audio = nextVideo, nextAudio
+		}
+	} else {
+		var inputs string
+		for i := range c.Segments {
+			inputs += fmt.Sprintf("[v%d][a%d]", i, i)
+		}
+		graph = append(graph, fmt.Sprintf("%sconcat=n=%d:v=1:a=1%s[a]", inputs, len(c.Segments), videoOut))
+	}
+
+	if upload != "" {
+		graph = append(graph, "[vj]"+upload+"[v]")
+	}
+
+	return strings.Join(graph, ";")
+}
+
+// Chapters returns an ffmetadata file with a chapter for each segment
+func (c *Compilation) Chapters() string {
+	b := &strings.Builder{}
+	b.WriteString(";FFMETADATA1\n")
+	fmt.Fprintf(b, "title=%s\n", escapeFfmetadata(c.Title))
+
+	starts := c.Starts()
+	for i, segment := range c.Segments {
+		end := starts[i] + segment.Duration()
+		if i < len(c.Segments)-1 {
+			end = starts[i+1]
+		}
+
+		b.WriteString("\n[CHAPTER]\n")
+		fmt.Fprintf(b, "TIMEBASE=1/%d\n", time.Second/compilationChapterTimebase)
+		fmt.Fprintf(b, "START=%d\n", starts[i]/compilationChapterTimebase)
+		fmt.Fprintf(b, "END=%d\n", end/compilationChapterTimebase)
+		fmt.Fprintf(b, "title=%s\n", escapeFfmetadata(fmt.Sprintf("%s (%s - %s)",
+			segment.Metadata.Name(), FormatTimestamp(segment.From), FormatTimestamp(segment.To))))
+	}
+
+	return b.String()
+}
+
+// Args returns the ffmpeg arguments that encode the compilation to target, with chapters read from chaptersPath
+func (c *Compilation) Args(chaptersPath, target string) []string {
+	encoder := NewEncoderPipeline(c.Codec, c.Device, c.QP)
+
+	args := []string{"-hide_banner", "-loglevel", "error"}
+	args = append(args, encoder.DeviceArgs()...)
+
+	pipes := 0
+	for _, segment := range c.Segments {
+		input := segment.Input
+		if input.List != "" {
+			// Each segment's concat list is passed through its own pipe, in the order of Pipes
+			input.URL = ffmpegPipe(pipes)
+			pipes++
+		}
+
+		args = append(args, ffmpeg.ConvertKwargsToCmdLineArgs(
+			input.InputArgs(FormatTimestamp(segment.From), FormatTimestamp(segment.To)),
+		)...)
+		args = append(args, "-i", input.URL)
+	}
+
+	args = append(args, "-f", "ffmetadata", "-i", chaptersPath)
+
+	output := encoder.Output()
+	output["filter_complex"] = c.FilterGraph(encoder.UploadFilter())
+	output["map"] = []string{"[v]", "[a]"}
+	output["map_metadata"] = len(c.Segments)
+	output["map_chapters"] = len(c.Segments)
+	output["movflags"] = "+use_metadata_tags+faststart"
+
+	args = append(args, ffmpeg.ConvertKwargsToCmdLineArgs(output)...)
+
+	return append(args, "-y", target)
+}
+
+// Pipes are what's passed to ffmpeg through pipes to read the segments
+func (c *Compilation) Pipes() []string {
+	var pipes []string
+	for _, segment := range c.Segments {
+		pipes = append(pipes, segment.Input.Pipes()...)
+	}
+	return pipes
+}
+
+// Run encodes the compilation to a file in dir and returns its path
+func (c *Compilation) Run(ctx context.Context, dir, filename string) (string, error) {
+	chapters, err := os.CreateTemp("", "cutscene-chapters-*.txt")
+	if err != nil {
+		return "", err
+	}
+
+	defer os.Remove(chapters.Name())
+
+	_, err = chapters.WriteString(c.Chapters())
+	if closeErr := chapters.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not write chapters: %w", err)
+	}
+
+	target := filepath.Join(dir, filename)
+
+	return target, runFfmpeg(ctx, c.Args(chapters.Name(), target), nil, target, c.Pipes()...)
+}
+
+// Compilation encodes the segments into a single file and returns its path
+func (a *Application) Compilation(ctx context.Context, segments []CompilationSegment, opts CompilationOptions) (string, error) {
+	if len(segments) == 0 || len(segments) > compilationMaxSegments {
+		return "", fmt.Errorf("a compilation must have between 1 and %d segments", compilationMaxSegments)
+	}
+	if opts.Crossfade < 0 || opts.Crossfade > compilationMaxCrossfade {
+		return "", fmt.Errorf("crossfade must be between 0 and %s", compilationMaxCrossfade)
+	}
+
+	c := &Compilation{
+		Title:     opts.Title,
+		Height:    opts.Height,
+		Crossfade: opts.Crossfade,
+		Codec:     a.capabilities.Usable(opts.Codec),
+		QP:        opts.QP,
+	}
+
+	if c.Title == "" {
+		c.Title = compilationDefaultTitle
+	}
+
+	for i, s := range segments {
+		metadata, err := a.metadata(ctx, s.RatingKey)
+		if err != nil {
+			return "", fmt.Errorf("segment %d: %w", i+1, err)
+		}
+
+		segmentMetadata := NewFfmpegParamsMetadata(*metadata)
+		if segmentMetadata.IsAudio() {
+			return "", fmt.Errorf("segment %d: tracks have no video and can't be included in compilations", i+1)
+		}
+
+		media, err := a.selectMedia(*metadata, s.MediaID, MediaTarget{Height: opts.Height, Codec: c.Codec.Software()})
+		if err != nil {
+			return "", fmt.Errorf("segment %d: %w", i+1, err)
+		}
+
+		segment := compilationSegment{
+			Source:   NewVideoSource(*media),
+			HasAudio: hasAudio(*media),
+			Metadata: segmentMetadata,
+		}
+		if err := segment.Source.Check(); err != nil {
+			return "", fmt.Errorf("segment %d: %w", i+1, err)
+		}
+
+		segment.From, err = ParseTimestamp(s.From)
+		if err != nil {
+			return "", fmt.Errorf("segment %d: %w", i+1, err)
+		}
+		segment.To, err = ParseTimestamp(s.To)
+		if err != nil {
+			return "", fmt.Errorf("segment %d: %w", i+1, err)
+		}
+		if segment.To <= segment.From {
+			return "", fmt.Errorf("segment %d: from must be before to", i+1)
+		}
+		if len(segments) > 1 && segment.Duration() <= c.Crossfade {
+			return "", fmt.Errorf("segment %d: must be longer than the crossfade", i+1)
+		}
+
+		input, err := a.partInput(mediaParts(*media), s.From, s.To)
+		if err != nil {
+			return "", fmt.Errorf("segment %d: %w", i+1, err)
+		}
+
+		segment.Input = *input
+
+		// The output takes its shape from the first segment, the rest are scaled and letterboxed to match
+		if i == 0 {
+			c.setFormat(*media)
+		}
+
+		c.Segments = append(c.Segments, segment)
+	}
+
+	// The title comes from the request, so it's sanitized to keep the file in the output directory
+	fileName := fmt.Sprintf("%s (%d clips).mp4", SanitizeFilename(c.Title), len(c.Segments))
+
+	ctx, cancel := a.jobContext(ctx)
+	defer cancel()
+
+	c.Device = a.devices.Acquire(c.Codec)
+	filePath, err := c.Run(ctx, "/tmp", fileName)
+	a.devices.Release(c.Device)
+
+	if err != nil && ctx.Err() == nil && c.Codec.HWAccel() != HWAccelNone {
+		log.Printf("compilation with %s on %s failed, falling back to %s: %v", c.Codec, c.Device, c.Codec.Software(), err)
+		c.Codec = c.Codec.Software()
+		c.Device = ""
+		return c.Run(ctx, "/tmp", fileName)
+	}
+
+	return filePath, err
+}
+
+// setFormat sets the output resolution and frame rate from the media
+func (c *Compilation) setFormat(media operations.GetMetadataMedia) {
+	aspectRatio := 16.0 / 9.0
+	if media.Width != nil && media.Height != nil && *media.Width > 0 && *media.Height > 0 {
+		aspectRatio = float64(*media.Width) / float64(*media.Height)
+	}
+
+	if c.Height <= 0 {
+		c.Height = compilationDefaultHeight
+		if media.Height != nil && *media.Height > 0 {
+			c.Height = *media.Height
+		}
+	}
+
+	// Encoders need even dimensions
+	c.Height = c.Height / 2 * 2
+	c.Width = int(math.Round(float64(c.Height)*aspectRatio/2)) * 2
+
+	c.FPS = compilationDefaultFPS
+	if stream := videoStream(media); stream != nil && stream.FrameRate != nil && *stream.FrameRate > 0 {
+		c.FPS = *stream.FrameRate
+	}
+}
+
+// hasAudio reports whether the media has an audio stream
+func hasAudio(media operations.GetMetadataMedia) bool {
+	if deref(media.AudioCodec) != "" {
+		return true
+	}
+
+	for _, part := range media.Part {
+		for _, stream := range part.Stream {
+			if stream.StreamType != nil && *stream.StreamType == plexStreamTypeAudio {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// escapeFfmetadata escapes the characters that are special in ffmetadata files
+func escapeFfmetadata(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `=`, `\=`, `;`, `\;`, `#`, `\#`, "\n", "\\\n").Replace(value)
+}
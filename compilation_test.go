@@ -0,0 +1,120 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCompilation is a compilation of two segments, the second of them HDR and read from Plex
+func testCompilation(codec Codec) *Compilation {
+	return &Compilation{
+		Segments: []compilationSegment{
+			{
+				Input:    PartInput{URL: "/media/show/episode.mkv"},
+				Source:   sdrSource,
+				HasAudio: true,
+				From:     5 * time.Minute,
+				To:       5*time.Minute + 10*time.Second,
+				Metadata: FfmpegParamsMetadata{Title: "Pilot"},
+			},
+			{
+				Input:    PartInput{URL: ffmpegPipe(0), List: "ffconcat version 1.0\n"},
+				Source:   hdr10Source,
+				HasAudio: true,
+				From:     time.Hour,
+				To:       time.Hour + 5*time.Second,
+				Metadata: FfmpegParamsMetadata{Title: "Movie"},
+			},
+		},
+		Title:  "Best bits",
+		Width:  1920,
+		Height: 1080,
+		FPS:    24,
+		Codec:  codec,
+		Device: "/dev/dri/renderD128",
+	}
+}
+
+func TestCompilationArgs(t *testing.T) {
+	tests := []struct {
+		name  string
+		codec Codec
+	}{
+		{name: "libx264", codec: CodecLibx264},
+		{name: "h264_vaapi", codec: CodecH264VAAPI},
+		{name: "h264_nvenc", codec: CodecH264NVENC},
+		{name: "h264_qsv", codec: CodecH264QSV},
+		{name: "libx265", codec: CodecLibx265},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := testCompilation(tt.codec).Args("/tmp/chapters.txt", "/tmp/Best bits (2 clips).mp4")
+			assertGolden(t, filepath.Join("compilation", tt.name), args)
+		})
+	}
+}
+
+func TestCompilationFilterGraph(t *testing.T) {
+	withoutAudio := testCompilation(CodecLibx264)
+	withoutAudio.Segments[0].HasAudio = false
+
+	crossfade := testCompilation(CodecLibx264)
+	crossfade.Segments = append(crossfade.Segments, crossfade.Segments[0])
+	crossfade.Crossfade = time.Second
+
+	dolbyVision := testCompilation(CodecLibx264)
+	dolbyVision.Segments[1].Source = dv5Source
+
+	tenBit := testCompilation(CodecLibx264)
+	tenBit.Segments[0].Source = tenBitSDR
+
+	upload := NewEncoderPipeline(CodecH264VAAPI, "/dev/dri/renderD128", 0).UploadFilter()
+
+	tests := []struct {
+		name        string
+		compilation *Compilation
+		upload      string
+	}{
+		{name: "cut", compilation: testCompilation(CodecLibx264)},
+		{name: "crossfade", compilation: crossfade},
+		{name: "without_audio", compilation: withoutAudio},
+		{name: "upload", compilation: testCompilation(CodecH264VAAPI), upload: upload},
+		{name: "crossfade_upload", compilation: crossfade, upload: upload},
+		{name: "dolby_vision_5", compilation: dolbyVision},
+		{name: "ten_bit_sdr", compilation: tenBit},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// One filter chain per line keeps the golden files readable
+			graph := strings.Split(tt.compilation.FilterGraph(tt.upload), ";")
+			assertGolden(t, filepath.Join("compilation", "filtergraph", tt.name), graph)
+		})
+	}
+}
+
+func TestCompilationStarts(t *testing.T) {
+	tests := []struct {
+		name      string
+		crossfade time.Duration
+		want      []time.Duration
+	}{
+		{name: "cut", want: []time.Duration{0, 10 * time.Second, 15 * time.Second}},
+		{name: "crossfade", crossfade: time.Second, want: []time.Duration{0, 9 * time.Second, 13 * time.Second}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testCompilation(CodecLibx264)
+			c.Segments = append(c.Segments, c.Segments[0])
+			c.Crossfade = tt.crossfade
+			if got := c.Starts(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Starts() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import "sync"
+
+const (
+	defaultRenderDevice = "/dev/dri/renderD128"
+	defaultCUDADevice   = "0"
+)
+
+// DevicePool hands out the hardware devices used for encoding. When more than one device is configured for a codec,
+// concurrent encodes are spread across them.
+type DevicePool struct {
+	mu sync.Mutex
+	// devices are keyed by codec (e.g. h264_vaapi) or hardware acceleration method (e.g. vaapi)
+	devices map[string][]string
+	inUse   map[string]int
+	next    map[Codec]int
+}
+
+func NewDevicePool(devices map[string][]string) *DevicePool {
+	return &DevicePool{
+		devices: devices,
+		inUse:   map[string]int{},
+		next:    map[Codec]int{},
+	}
+}
+
+// Devices returns the devices configured for the codec, falling back to those configured for its hardware
+// acceleration method and then the default device.
+func (p *DevicePool) Devices(codec Codec) []string {
+	if devices := p.devices[string(codec)]; len(devices) > 0 {
+		return devices
+	}
+	if devices := p.devices[string(codec.HWAccel())]; len(devices) > 0 {
+		return devices
+	}
+
+	switch codec.HWAccel() {
+	case HWAccelVAAPI, HWAccelQSV:
+		return []string{defaultRenderDevice}
+	case HWAccelCUDA:
+		return []string{defaultCUDADevice}
+	default:
+		return nil
+	}
+}
+
+// Acquire returns the least busy device for the codec, taking turns between equally busy devices.
+// An empty string is returned for software codecs. The device must be returned with Release once the encode is done.
+func (p *DevicePool) Acquire(codec Codec) string {
+	devices := p.Devices(codec)
+	if len(devices) == 0 {
+		return ""
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	start := p.next[codec]
+	p.next[codec] = (start + 1) % len(devices)
+
+	device := devices[start]
+	for i := 1; i < len(devices); i++ {
+		candidate := devices[(start+i)%len(devices)]
+		if p.inUse[candidate] < p.inUse[device] {
+			device = candidate
+		}
+	}
+
+	p.inUse[device]++
+
+	return device
+}
+
+func (p *DevicePool) Release(device string) {
+	if device == "" {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.inUse[device]--
+}
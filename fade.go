@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Fade fades the start of a clip in from black and silence, and the end out to them
+type Fade struct {
+	In  time.Duration
+	Out time.Duration
+}
+
+func (f Fade) IsZero() bool {
+	return f.In <= 0 && f.Out <= 0
+}
+
+// Validate checks that the fades fit in a clip of the duration
+func (f Fade) Validate(duration time.Duration) error {
+	if f.In < 0 || f.Out < 0 {
+		return fmt.Errorf("fade durations can't be negative")
+	}
+	if f.In+f.Out > duration {
+		return fmt.Errorf("fades are longer than the clip")
+	}
+	return nil
+}
+
+// VideoFilters returns the fade filters for a clip of the duration. Timestamps start at 0 since the input is seeked.
+func (f Fade) VideoFilters(duration time.Duration) []string {
+	var filters []string
+
+	if f.In > 0 {
+		filters = append(filters, "fade=t=in:st=0:d="+formatSeconds(f.In))
+	}
+	if f.Out > 0 {
+		filters = append(filters, "fade=t=out:st="+formatSeconds(duration-f.Out)+":d="+formatSeconds(f.Out))
+	}
+
+	return filters
+}
+
+// AudioFilters returns the afade filters that match VideoFilters
+func (f Fade) AudioFilters(duration time.Duration) []string {
+	var filters []string
+
+	if f.In > 0 {
+		filters = append(filters, "afade=t=in:st=0:d="+formatSeconds(f.In))
+	}
+	if f.Out > 0 {
+		filters = append(filters, "afade=t=out:st="+formatSeconds(duration-f.Out)+":d="+formatSeconds(f.Out))
+	}
+
+	return filters
+}
+
+func formatSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+}
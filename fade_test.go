@@ -0,0 +1,76 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFadeFilters(t *testing.T) {
+	tests := []struct {
+		name      string
+		fade      Fade
+		wantVideo []string
+		wantAudio []string
+	}{
+		{name: "no fades", fade: Fade{}},
+		{
+			name:      "fade in",
+			fade:      Fade{In: time.Second},
+			wantVideo: []string{"fade=t=in:st=0:d=1.000"},
+			wantAudio: []string{"afade=t=in:st=0:d=1.000"},
+		},
+		{
+			name:      "fade out",
+			fade:      Fade{Out: 1500 * time.Millisecond},
+			wantVideo: []string{"fade=t=out:st=8.500:d=1.500"},
+			wantAudio: []string{"afade=t=out:st=8.500:d=1.500"},
+		},
+		{
+			name:      "both",
+			fade:      Fade{In: 250 * time.Millisecond, Out: 2 * time.Second},
+			wantVideo: []string{"fade=t=in:st=0:d=0.250", "fade=t=out:st=8.000:d=2.000"},
+			wantAudio: []string{"afade=t=in:st=0:d=0.250", "afade=t=out:st=8.000:d=2.000"},
+		},
+		{
+			name:      "the whole clip",
+			fade:      Fade{In: 5 * time.Second, Out: 5 * time.Second},
+			wantVideo: []string{"fade=t=in:st=0:d=5.000", "fade=t=out:st=5.000:d=5.000"},
+			wantAudio: []string{"afade=t=in:st=0:d=5.000", "afade=t=out:st=5.000:d=5.000"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.fade.VideoFilters(10 * time.Second); !reflect.DeepEqual(got, tt.wantVideo) {
+				t.Errorf("VideoFilters() = %q, want %q", got, tt.wantVideo)
+			}
+			if got := tt.fade.AudioFilters(10 * time.Second); !reflect.DeepEqual(got, tt.wantAudio) {
+				t.Errorf("AudioFilters() = %q, want %q", got, tt.wantAudio)
+			}
+		})
+	}
+}
+
+func TestFadeValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		fade    Fade
+		wantErr bool
+	}{
+		{name: "no fades", fade: Fade{}},
+		{name: "fits", fade: Fade{In: time.Second, Out: time.Second}},
+		{name: "exactly the clip", fade: Fade{In: 4 * time.Second, Out: 6 * time.Second}},
+		{name: "longer than the clip", fade: Fade{In: 5 * time.Second, Out: 6 * time.Second}, wantErr: true},
+		{name: "negative in", fade: Fade{In: -time.Second}, wantErr: true},
+		{name: "negative out", fade: Fade{Out: -time.Second}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.fade.Validate(10 * time.Second); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() returned %v, want an error: %t", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -1,215 +1,416 @@
 package main
 
 import (
-	"bytes"
-	"errors"
+	"context"
 	"fmt"
-	ffmpeg "github.com/u2takey/ffmpeg-go"
 	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
 	"strconv"
-)
+	"strings"
+	"sync"
+	"time"
 
-type Codec string
-
-const (
-	CodecH264VAAPI Codec = "h264_vaapi"
-	CodecH264NVENC Codec = "h264_nvenc"
-	CodecLibx264   Codec = "libx264"
+	"github.com/LukeHagar/plexgo/models/operations"
+	ffmpeg "github.com/u2takey/ffmpeg-go"
 )
 
 type FfmpegParams struct {
-	URL      string
-	From     string
-	To       string
+	URL string
+	// Offset is where URL starts in the media, for media that's split into parts
+	Offset time.Duration
+	// List is the concat demuxer list that URL reads, for media that's read from Plex or ranges that span parts
+	List string
+	From string
+	To   string
+	// Dir is the directory the output file is written to, /tmp if empty
+	Dir      string
 	Filename string
 	Height   int
 	QP       int
 	Codec    Codec
+	Device   string
+	Source   VideoSource
+	HDRMode  HDRMode
 	Metadata FfmpegParamsMetadata
+	Overlay  Overlay
+	Framing  Framing
+	Playback Playback
+	Audio    Audio
+	Fade     Fade
+
+	Container Container
+	// Output is written to instead of a file when set
+	Output io.Writer
 }
 
 type FfmpegParamsMetadata struct {
-	Title        string
+	Title string
+	Year  int
+
+	// Show, SeasonNumber and EpisodeID are only set for episodes
 	Show         string
 	SeasonNumber int
 	EpisodeID    int
-	Year         int
+
+	// Artist is set for music tracks and music videos, the rest are only set for tracks
+	Artist      string
+	Album       string
+	TrackNumber int
+	DiscNumber  int
+
+	Summary string
+	Genres  []string
+	Studio  string
+	// Network is the studio of the episode's show, which isn't included in the episode's metadata
+	Network string
+	// ReleaseDate is the date the media was first released or aired, in YYYY-MM-DD format
+	ReleaseDate string
+	RatingKey   string
+	// Type is the Plex metadata type, e.g. movie or episode
+	Type string
+	// GUIDs are the IDs of the media in other databases, keyed by the database (imdb, tmdb or tvdb)
+	GUIDs map[string]string
+}
+
+// Input is the part input that the params read from
+func (p FfmpegParams) Input() PartInput {
+	return PartInput{URL: p.URL, Offset: p.Offset, List: p.List}
 }
 
-func DoFfmpeg(params FfmpegParams) (string, error) {
-	outputMetadata := map[string]string{
-		"title":   params.Metadata.Title,
-		"comment": params.From,
+func NewFfmpegParamsMetadata(metadata operations.GetMetadataMetadata) FfmpegParamsMetadata {
+	var m FfmpegParamsMetadata
+
+	if metadata.Title != nil {
+		m.Title = *metadata.Title
+	}
+	if metadata.Type != nil {
+		m.Type = *metadata.Type
 	}
 
-	if params.Metadata.Show != "" {
-		outputMetadata["show"] = params.Metadata.Show
+	// The parent and grandparent fields mean different things for each type
+	switch m.Type {
+	case MediaTypeEpisode:
+		m.Show = deref(metadata.GrandparentTitle)
+		m.SeasonNumber = deref(metadata.ParentIndex)
+		m.EpisodeID = deref(metadata.Index)
+	case MediaTypeTrack:
+		m.Artist = deref(metadata.GrandparentTitle)
+		m.Album = deref(metadata.ParentTitle)
+		m.TrackNumber = deref(metadata.Index)
+		m.DiscNumber = deref(metadata.ParentIndex)
+	case MediaTypeClip:
+		// Music videos are clips with the artist as their grandparent
+		m.Artist = deref(metadata.GrandparentTitle)
+	default:
 	}
-	if params.Metadata.SeasonNumber != 0 {
-		outputMetadata["season_number"] = strconv.Itoa(params.Metadata.SeasonNumber)
+
+	if metadata.Year != nil {
+		m.Year = *metadata.Year
+	}
+	if metadata.Summary != nil {
+		m.Summary = *metadata.Summary
+	}
+	for _, genre := range metadata.Genre {
+		if genre.Tag != nil {
+			m.Genres = append(m.Genres, *genre.Tag)
+		}
+	}
+	if metadata.Studio != nil {
+		m.Studio = *metadata.Studio
 	}
-	if params.Metadata.EpisodeID != 0 {
-		outputMetadata["episode_id"] = strconv.Itoa(params.Metadata.EpisodeID)
+	if metadata.OriginallyAvailableAt != nil {
+		m.ReleaseDate = metadata.OriginallyAvailableAt.String()
 	}
-	if params.Metadata.Year != 0 {
-		outputMetadata["year"] = strconv.Itoa(params.Metadata.Year)
+	if metadata.RatingKey != nil {
+		m.RatingKey = *metadata.RatingKey
 	}
 
-	var metadataArr []string
-	for k, v := range outputMetadata {
-		metadataArr = append(metadataArr, fmt.Sprintf("%s=%s", k, v))
+	// GUIDs are in the format imdb://tt0000000
+	for _, guid := range metadata.Guids {
+		if guid.ID == nil {
+			continue
+		}
+		if source, id, ok := strings.Cut(*guid.ID, "://"); ok {
+			if m.GUIDs == nil {
+				m.GUIDs = map[string]string{}
+			}
+			m.GUIDs[source] = id
+		}
 	}
 
-	tmpFile := filepath.Join("/tmp", params.Filename)
+	return m
+}
 
-	inputArgs := ffmpeg.KwArgs{
-		"ss":      params.From,
-		"to":      params.To,
-		"hwaccel": "auto",
-		// TODO: Make these two configurable, we don't want them when trying to troubleshoot
-		"hide_banner": "",
-		"loglevel":    "error",
+// Caption is the short description drawn over a clip starting at from, e.g. "Show S01E02 – 00:05:00"
+func (m FfmpegParamsMetadata) Caption(from string) string {
+	if m.Show != "" {
+		return fmt.Sprintf("%s S%02dE%02d – %s", m.Show, m.SeasonNumber, m.EpisodeID, from)
 	}
+	return fmt.Sprintf("%s – %s", m.Name(), from)
+}
 
-	switch params.Codec {
-	case CodecH264VAAPI:
-		inputArgs["hwaccel"] = "vaapi"
-		inputArgs["hwaccel_device"] = "/dev/dri/renderD128"
-		inputArgs["hwaccel_output_format"] = "vaapi"
-	case CodecH264NVENC:
-		inputArgs["hwaccel"] = "cuda"
-		inputArgs["extra_hw_frames"] = 8
-	case CodecLibx264:
-		fallthrough
-	default:
+// Name is what files exported from the media are named after, e.g. "Show S01E02 Episode", "Artist - Track" or
+// "Movie (2024)"
+func (m FfmpegParamsMetadata) Name() string {
+	if m.Title == "" {
+		m.Title = "Untitled"
+	}
+	if m.Show != "" {
+		return fmt.Sprintf("%s S%02dE%02d %s", m.Show, m.SeasonNumber, m.EpisodeID, m.Title)
+	}
+	if m.Artist != "" {
+		return fmt.Sprintf("%s - %s", m.Artist, m.Title)
 	}
+	if m.Year != 0 {
+		return fmt.Sprintf("%s (%d)", m.Title, m.Year)
+	}
+	return m.Title
+}
 
-	// TODO: Might be a good idea to make these configurable or add support for presets
-	outputArgs := ffmpeg.KwArgs{
-		"acodec":       "aac",
-		"map_chapters": -1,
-		"map_metadata": 0,
-		"movflags":     "+use_metadata_tags+faststart",
-		"metadata":     metadataArr,
-		"qp":           params.QP,
-	}
-
-	outputArgs["vcodec"] = params.Codec
-
-	switch params.Codec {
-	case CodecH264VAAPI:
-		outputArgs["vf"] = "hwupload,scale_vaapi=format=nv12,scale_vaapi=-2:" + strconv.Itoa(params.Height)
-		outputArgs["compression_level"] = "0" // https://trac.ffmpeg.org/wiki/Hardware/VAAPI#AMDMesa
-	case CodecH264NVENC:
-		inputArgs["hwaccel_output_format"] = "cuda"
-		if params.Height > 0 {
-			outputArgs["vf"] = "scale_cuda=-2:" + strconv.Itoa(params.Height)
+// DoFfmpeg encodes a clip to a file and returns its path
+func DoFfmpeg(ctx context.Context, params FfmpegParams) (string, error) {
+	params.Output = nil
+
+	pipeline := NewPipeline(params)
+	err := pipeline.Run(ctx)
+
+	return pipeline.Target(), err
+}
+
+// DoFfmpegPreview streams a browser-friendly encode to the writer
+func DoFfmpegPreview(ctx context.Context, params FfmpegParams, writer io.Writer) error {
+	params = previewParams(params)
+	params.Container = ContainerFragmentedMP4
+	params.Output = writer
+
+	return NewPipeline(params).Run(ctx)
+}
+
+// DoFfmpegPreviewSegment encodes a browser-friendly HLS segment to a file and returns its path
+func DoFfmpegPreviewSegment(ctx context.Context, params FfmpegParams) (string, error) {
+	params = previewParams(params)
+	params.Container = ContainerMPEGTS
+
+	return DoFfmpeg(ctx, params)
+}
+
+// FrameParams describes a single frame to extract from a video
+type FrameParams struct {
+	// Input is the part that the frame is read from, At is relative to its start
+	Input  PartInput
+	At     time.Duration
+	Height int
+	Source VideoSource
+	// HDRMode keep skips tonemapping 10-bit sources
+	HDRMode HDRMode
+	// Subtitles are burned into the frame if they're not nil
+	Subtitles *SubtitleSource
+	// Path is the file the frame is written to, its extension determines the image format
+	Path string
+}
+
+// DoFfmpegFrame extracts the frame at params.At to an image
+func DoFfmpegFrame(ctx context.Context, params FrameParams) error {
+	if err := params.Source.Check(); err != nil {
+		return err
+	}
+
+	// The subtitles filter opens its file itself, so it can't read subtitles through the concat lists that Plex is
+	// read through
+	if params.Subtitles != nil && !params.Subtitles.Image {
+		list := params.Input.List
+		if params.Subtitles.URL != "" {
+			list = params.Subtitles.List
 		}
-		if params.QP == 0 {
-			outputArgs["rc"] = "constqp"
-			outputArgs["qp"] = 24
-			outputArgs["b:v"] = "0K"
+
+		if list != "" {
+			path, err := localSubtitles(ctx, params.Input, params.Subtitles)
+			if err != nil {
+				return err
+			}
+			defer os.Remove(path)
+
+			params.Subtitles = &SubtitleSource{URL: path}
 		}
-	case CodecLibx264:
-		fallthrough
-	default:
-		outputArgs["vf"] = "scale=-2:" + strconv.Itoa(params.Height)
-		outputArgs["pix_fmt"] = "yuv420p"
-		outputArgs["crf"] = 23
-		outputArgs["video_bitrate"] = 0
-		// TODO: I'm not sure if this does anything useful
-		outputArgs["tune"] = "film"
-	}
-
-	errBuff := &bytes.Buffer{}
-	err := ffmpeg.
-		Input(params.URL, inputArgs).
-		Output(tmpFile, outputArgs).
-		OverWriteOutput().
-		WithErrorOutput(errBuff).
-		WithOutput(os.Stdout).
-		Run()
-
-	// Capture the ffmpeg process stderr if it exits unsuccessfully
-	var exitErr *exec.ExitError
-	if errors.As(err, &exitErr) {
-		err = fmt.Errorf("ffmpeg exited with error:\n%s", errBuff.String())
-	}
-
-	_, _ = io.Copy(os.Stderr, errBuff)
-
-	return tmpFile, err
-}
-
-func DoFfmpegPreview(fileURL, from, to string, codec Codec, writer io.Writer) error {
-	inputArgs := ffmpeg.KwArgs{
-		"ss":      from,
-		"to":      to,
-		"hwaccel": "auto",
-		// TODO: Make these two configurable, we don't want them when trying to troubleshoot
-		"hide_banner": "",
-		"loglevel":    "error",
-	}
-
-	switch codec {
-	case CodecH264VAAPI:
-		inputArgs["hwaccel"] = "vaapi"
-		inputArgs["hwaccel_device"] = "/dev/dri/renderD128"
-		inputArgs["hwaccel_output_format"] = "vaapi"
-	case CodecH264NVENC:
-		inputArgs["hwaccel"] = "cuda"
-	case CodecLibx264:
-		fallthrough
-	default:
 	}
 
+	return runFfmpeg(ctx, frameArgs(params), nil, params.Path, params.Input.Pipes()...)
+}
+
+// frameArgs returns the ffmpeg arguments that extract the frame. Text subtitles must already be readable by the
+// subtitles filter.
+func frameArgs(params FrameParams) []string {
+	inputArgs := ffmpeg.MergeKwArgs([]ffmpeg.KwArgs{
+		params.Input.InputArgs(FormatTimestamp(params.At), ""),
+		{
+			"hide_banner": "",
+			"loglevel":    "error",
+		},
+	})
+
 	outputArgs := ffmpeg.KwArgs{
-		"acodec":   "libvorbis",
-		"f":        "mp4",
-		"movflags": "frag_keyframe+empty_moov",
-		// TODO
-		//"qp":           params.QP,
-	}
-
-	outputArgs["vcodec"] = codec
-
-	height := 720
-
-	switch codec {
-	case CodecH264VAAPI:
-		outputArgs["vf"] = "hwupload,scale_vaapi=format=nv12,scale_vaapi=-2:" + strconv.Itoa(height)
-		outputArgs["compression_level"] = "0" // https://trac.ffmpeg.org/wiki/Hardware/VAAPI#AMDMesa
-	case CodecH264NVENC:
-		inputArgs["hwaccel_output_format"] = "cuda"
-		outputArgs["vf"] = "scale_cuda=-2:" + strconv.Itoa(height)
-	case CodecLibx264:
-		fallthrough
+		"frames:v": 1,
+	}
+
+	switch strings.ToLower(filepath.Ext(params.Path)) {
+	case ".jpg", ".jpeg":
+		outputArgs["q:v"] = 3
+	case ".webp":
+		outputArgs["quality"] = 90
 	default:
-		outputArgs["vf"] = "scale=-2:" + strconv.Itoa(height)
-		outputArgs["pix_fmt"] = "yuv420p"
-		outputArgs["crf"] = 23
-		outputArgs["video_bitrate"] = 0
-		// TODO: I'm not sure if this does anything useful
-		outputArgs["tune"] = "film"
 	}
 
-	errBuff := &bytes.Buffer{}
-	err := ffmpeg.
-		Input(fileURL, inputArgs).
-		Output("pipe:", outputArgs).
-		WithOutput(writer, errBuff).
-		Run()
+	var filters []string
+	if params.Source.Is10Bit() && (params.HDRMode != HDRModeKeep || params.Source.DolbyVisionProfile5) {
+		filters = append(filters, tonemapSoftware(params.Source))
+	}
+
+	var scale string
+	if params.Height > 0 {
+		scale = "scale=-2:" + strconv.Itoa(params.Height)
+	}
+
+	if params.Subtitles != nil {
+		// Subtitles are timed against the original timestamps rather than ones starting from the seek point
+		inputArgs["copyts"] = ""
+	}
+
+	if params.Subtitles != nil && params.Subtitles.Image {
+		// Bitmap subtitles are overlaid after tonemapping and before scaling so that they're scaled with the video
+		graph := "[0:v]"
+		if len(filters) > 0 {
+			graph += strings.Join(filters, ",") + "[base];[base]"
+		}
+		graph += fmt.Sprintf("[0:%d]overlay", params.Subtitles.StreamIndex)
+		if scale != "" {
+			graph += "," + scale
+		}
+		outputArgs["filter_complex"] = graph + "[v]"
+		outputArgs["map"] = "[v]"
+	} else {
+		if params.Subtitles != nil {
+			// The subtitles filter reads the subtitle stream separately, which for embedded subtitles means reading
+			// through the media file
+			filters = append(filters, params.Subtitles.Filter(params.Input.URL))
+		}
+		if scale != "" {
+			filters = append(filters, scale)
+		}
+		if len(filters) > 0 {
+			outputArgs["vf"] = strings.Join(filters, ",")
+		}
+	}
+
+	stream := ffmpeg.
+		Input(params.Input.URL, inputArgs).
+		Output(params.Path, outputArgs).
+		OverWriteOutput()
+
+	return stream.GetArgs()
+}
+
+func previewParams(params FfmpegParams) FfmpegParams {
+	// Browsers have inconsistent support for HEVC and AV1, and can't be relied on to display HDR,
+	// so previews are always tonemapped H.264
+	params.Codec = params.Codec.H264()
+	params.HDRMode = HDRModeTonemap
+
+	if params.Height == 0 {
+		params.Height = 720
+	}
+
+	return params
+}
+
+var (
+	ffmpegListingsMu sync.Mutex
+	ffmpegListings   = map[string][]string{}
+)
+
+// ffmpegListing returns the names from one of ffmpeg's listings (e.g. -filters or -encoders).
+// The result is cached since the ffmpeg build doesn't change while we're running.
+func ffmpegListing(flag string) []string {
+	ffmpegListingsMu.Lock()
+	defer ffmpegListingsMu.Unlock()
+
+	if names, ok := ffmpegListings[flag]; ok {
+		return names
+	}
+
+	var names []string
+	out, err := exec.Command("ffmpeg", "-hide_banner", flag).Output()
+	if err == nil {
+		for _, line := range strings.Split(string(out), "\n") {
+			// Each entry is formatted as " <capability flags> <name> <description>"
+			fields := strings.Fields(line)
+			if len(fields) >= 2 {
+				names = append(names, fields[1])
+			}
+		}
+	}
+
+	ffmpegListings[flag] = names
+
+	return names
+}
+
+// ffmpegHasFilter reports whether the local ffmpeg build includes the named filter
+func ffmpegHasFilter(name string) bool {
+	return slices.Contains(ffmpegListing("-filters"), name)
+}
+
+// ffmpegHasEncoder reports whether the local ffmpeg build includes the named encoder
+func ffmpegHasEncoder(name string) bool {
+	return slices.Contains(ffmpegListing("-encoders"), name)
+}
+
+// DoFfmpegSubtitles converts the subtitle stream to SRT and writes it to w. input is the part the subtitles are
+// embedded in, sidecar subtitles are read from their own URL instead.
+func DoFfmpegSubtitles(ctx context.Context, input PartInput, subtitles *SubtitleSource, w io.Writer) error {
+	outputArgs := ffmpeg.KwArgs{
+		"f": "srt",
+	}
+
+	if subtitles.URL != "" {
+		input = PartInput{URL: subtitles.URL, List: subtitles.List}
+	} else {
+		outputArgs["map"] = fmt.Sprintf("0:s:%d", subtitles.SubtitleIndex)
+	}
+
+	inputArgs := ffmpeg.MergeKwArgs([]ffmpeg.KwArgs{
+		input.InputArgs("", ""),
+		{
+			"hide_banner": "",
+			"loglevel":    "error",
+		},
+	})
+
+	stream := ffmpeg.
+		Input(input.URL, inputArgs).
+		Output("pipe:", outputArgs)
+
+	return runFfmpeg(ctx, stream.GetArgs(), w, "", input.Pipes()...)
+}
 
-	// Capture the ffmpeg process stderr if it exits unsuccessfully
-	var exitErr *exec.ExitError
-	if errors.As(err, &exitErr) {
-		err = fmt.Errorf("ffmpeg exited with error:\n%s", errBuff.String())
+// localSubtitles converts text subtitles that are read from Plex to a temporary SRT file and returns its path, which
+// the caller removes
+func localSubtitles(ctx context.Context, input PartInput, subtitles *SubtitleSource) (string, error) {
+	f, err := os.CreateTemp("", "cutscene-subtitles-*.srt")
+	if err != nil {
+		return "", err
 	}
 
-	_, _ = io.Copy(os.Stderr, errBuff)
+	err = DoFfmpegSubtitles(ctx, input, subtitles, f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return "", fmt.Errorf("could not extract subtitles: %w", err)
+	}
 
-	return err
+	return f.Name(), nil
 }
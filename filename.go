@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// DefaultFilenameTemplate names clips like "Show S01E02 Episode (00.05.00 - 00.05.10)"
+	DefaultFilenameTemplate = "{{.Name}} ({{.Range}})"
+	// filenameMaxLength is the maximum length in bytes of a file name, without its extension. Most filesystems allow
+	// 255 bytes, some room is left for the extension and temporary file prefixes.
+	filenameMaxLength = 200
+	// filenameFallback is used when the template produces an empty file name
+	filenameFallback = "clip"
+)
+
+// filenameReplacer replaces the characters that aren't allowed in file names on Windows, macOS or Linux.
+// Colons in timestamps become dots so that they're still readable.
+var filenameReplacer = strings.NewReplacer(
+	":", ".",
+	"/", "-",
+	"\\", "-",
+	"|", "-",
+	`"`, "'",
+	"<", "(",
+	">", ")",
+	"?", "",
+	"*", "",
+)
+
+// windowsReservedNames can't be used as file names on Windows, even with an extension
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+var filenameFuncs = template.FuncMap{
+	// default returns the fallback if the value is empty, e.g. {{default "Unknown" .Show}}
+	"default": func(fallback string, value any) any {
+		switch v := value.(type) {
+		case string:
+			if v == "" {
+				return fallback
+			}
+		case int:
+			if v == 0 {
+				return fallback
+			}
+		case nil:
+			return fallback
+		}
+		return value
+	},
+	"join": strings.Join,
+}
+
+// FilenameTemplate names clips from their metadata
+type FilenameTemplate struct {
+	tmpl *template.Template
+}
+
+// FilenameData is what's available to filename templates. All of the metadata fields can be used, e.g. {{.Show}}.
+type FilenameData struct {
+	FfmpegParamsMetadata
+	// Name is the default name of the media, e.g. "Show S01E02 Episode" or "Movie (2024)"
+	Name string
+	From string
+	To   string
+	// Range is "from - to", followed by any changes to the playback, e.g. "00:05:00 - 00:05:10, 2x reversed"
+	Range string
+}
+
+func ParseFilenameTemplate(s string) (*FilenameTemplate, error) {
+	if s == "" {
+		s = DefaultFilenameTemplate
+	}
+
+	tmpl, err := template.New("filename").Funcs(filenameFuncs).Option("missingkey=zero").Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse filename template: %w", err)
+	}
+
+	// Field names are only checked when the template is executed, so check them now rather than when clipping
+	if err := tmpl.Execute(&bytes.Buffer{}, FilenameData{}); err != nil {
+		return nil, fmt.Errorf("invalid filename template: %w", err)
+	}
+
+	return &FilenameTemplate{tmpl: tmpl}, nil
+}
+
+// Filename returns the sanitized file name for the data with the extension
+func (t *FilenameTemplate) Filename(data FilenameData, ext string) (string, error) {
+	b := &bytes.Buffer{}
+	if err := t.tmpl.Execute(b, data); err != nil {
+		return "", fmt.Errorf("could not execute filename template: %w", err)
+	}
+
+	return SanitizeFilename(b.String()) + ext, nil
+}
+
+// SanitizeFilename makes the name safe to use as a file name on any platform
+func SanitizeFilename(name string) string {
+	name = filenameReplacer.Replace(name)
+
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == utf8.RuneError {
+			return -1
+		}
+		return r
+	}, name)
+
+	// Collapse the whitespace left by missing fields
+	name = strings.Join(strings.Fields(name), " ")
+
+	if len(name) > filenameMaxLength {
+		name = name[:filenameMaxLength]
+		// Don't cut a multi-byte character in half
+		for !utf8.ValidString(name) {
+			name = name[:len(name)-1]
+		}
+	}
+
+	// Windows doesn't allow names that end in a dot or space
+	name = strings.TrimRight(name, ". ")
+
+	base, _, _ := strings.Cut(name, ".")
+	if windowsReservedNames[strings.ToUpper(strings.TrimSpace(base))] {
+		name = "_" + name
+	}
+
+	if name == "" {
+		return filenameFallback
+	}
+
+	return name
+}
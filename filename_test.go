@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitizeFilename(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{name: "unchanged", in: "Breaking Bad S01E01 Pilot", want: "Breaking Bad S01E01 Pilot"},
+		{name: "timestamps", in: "Movie (00:05:00 - 00:05:10)", want: "Movie (00.05.00 - 00.05.10)"},
+		{name: "separators", in: `AC/DC - Back\In|Black`, want: "AC-DC - Back-In-Black"},
+		{name: "reserved characters", in: `Who? "Me" <*>`, want: "Who 'Me' ()"},
+		{name: "control characters", in: "Line\nbreak\x00", want: "Linebreak"},
+		{name: "whitespace", in: "  Show    S01E01  ", want: "Show S01E01"},
+		{name: "path traversal", in: "../../etc/passwd", want: "..-..-etc-passwd"},
+		{name: "trailing dots", in: "Title...", want: "Title"},
+		{name: "reserved name", in: "con", want: "_con"},
+		{name: "reserved name with extension", in: "NUL.txt", want: "_NUL.txt"},
+		{name: "empty", in: "", want: filenameFallback},
+		{name: "only removed characters", in: "?*", want: filenameFallback},
+		{name: "truncated", in: strings.Repeat("a", filenameMaxLength+10), want: strings.Repeat("a", filenameMaxLength)},
+		{name: "truncated multi-byte", in: strings.Repeat("a", filenameMaxLength-1) + "é", want: strings.Repeat("a", filenameMaxLength-1)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SanitizeFilename(tt.in); got != tt.want {
+				t.Errorf("SanitizeFilename(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+// cropDetectDuration is how much of the clip is scanned for black bars
+const cropDetectDuration = 10 * time.Second
+
+// CropRect is a region of the source video in pixels
+type CropRect struct {
+	Width  int
+	Height int
+	X      int
+	Y      int
+}
+
+// ParseCropRect parses a crop in the same w:h:x:y format as ffmpeg's crop filter
+func ParseCropRect(s string) (*CropRect, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("crop must be in the format w:h:x:y")
+	}
+
+	values := make([]int, len(parts))
+	for i, part := range parts {
+		v, err := strconv.Atoi(part)
+		if err != nil || v < 0 {
+			return nil, fmt.Errorf("crop must be in the format w:h:x:y")
+		}
+		values[i] = v
+	}
+
+	if values[0] == 0 || values[1] == 0 {
+		return nil, fmt.Errorf("crop width and height must be greater than 0")
+	}
+
+	return &CropRect{Width: values[0], Height: values[1], X: values[2], Y: values[3]}, nil
+}
+
+func (c CropRect) Filter() string {
+	return fmt.Sprintf("crop=%d:%d:%d:%d", c.Width, c.Height, c.X, c.Y)
+}
+
+// AspectRatio is a width:height ratio such as 9:16
+type AspectRatio struct {
+	Width  int
+	Height int
+}
+
+func ParseAspectRatio(s string) (AspectRatio, error) {
+	if s == "" {
+		return AspectRatio{}, nil
+	}
+
+	w, h, ok := strings.Cut(s, ":")
+	width, wErr := strconv.Atoi(w)
+	height, hErr := strconv.Atoi(h)
+	if !ok || wErr != nil || hErr != nil || width <= 0 || height <= 0 {
+		return AspectRatio{}, fmt.Errorf("aspect ratio must be in the format w:h, e.g. 9:16")
+	}
+
+	return AspectRatio{Width: width, Height: height}, nil
+}
+
+func (a AspectRatio) IsZero() bool {
+	return a.Width == 0 || a.Height == 0
+}
+
+// FramingMode determines how the video is fitted to a different aspect ratio
+type FramingMode string
+
+const (
+	// FramingModeCrop crops the center of the video to the aspect ratio
+	FramingModeCrop FramingMode = "crop"
+	// FramingModeBlur fits the whole video inside the aspect ratio, over a blurred and zoomed copy of itself
+	FramingModeBlur FramingMode = "blur"
+)
+
+func ParseFramingMode(s string) (FramingMode, error) {
+	switch FramingMode(s) {
+	case "":
+		return FramingModeCrop, nil
+	case FramingModeCrop, FramingModeBlur:
+		return FramingMode(s), nil
+	default:
+		return "", fmt.Errorf("unknown framing mode %q", s)
+	}
+}
+
+// Framing crops and reframes the source video before it's scaled
+type Framing struct {
+	// Crop is applied first, e.g. to remove black bars
+	Crop *CropRect
+	// AutoCrop detects black bars with cropdetect, which then sets Crop
+	AutoCrop bool
+	Aspect   AspectRatio
+	Mode     FramingMode
+}
+
+func (f Framing) IsZero() bool {
+	return f.Crop == nil && !f.AutoCrop && f.Aspect.IsZero()
+}
+
+// Filters returns the software filters that frame the source and scale it to height.
+// A height of 0 keeps the height of the (cropped) source.
+func (f Framing) Filters(source VideoSource, height int) []string {
+	var filters []string
+
+	contentHeight := source.Height
+	if f.Crop != nil {
+		filters = append(filters, f.Crop.Filter())
+		contentHeight = f.Crop.Height
+	}
+
+	if f.Aspect.IsZero() {
+		return append(filters, fmt.Sprintf("scale=-2:%d", height))
+	}
+
+	if f.Mode == FramingModeBlur {
+		if height <= 0 {
+			height = contentHeight
+		}
+		if height <= 0 {
+			height = 1080
+		}
+
+		// Encoders need even dimensions
+		h := height / 2 * 2
+		w := int(math.Round(float64(h)*float64(f.Aspect.Width)/float64(f.Aspect.Height)/2)) * 2
+
+		// The graph's input and output are unlabelled so that it can be chained with the other filters
+		return append(filters, strings.Join([]string{
+			"split[fg][bg]",
+			fmt.Sprintf("[bg]scale=%d:%d:force_original_aspect_ratio=increase,crop=%d:%d,boxblur=20[bg]", w, h, w, h),
+			fmt.Sprintf("[fg]scale=%d:%d:force_original_aspect_ratio=decrease[fg]", w, h),
+			"[bg][fg]overlay=(W-w)/2:(H-h)/2,setsar=1",
+		}, ";"))
+	}
+
+	// Crop the largest centered region with the aspect ratio. Commas in the expressions are escaped for the filtergraph.
+	ratio := fmt.Sprintf("%d/%d", f.Aspect.Width, f.Aspect.Height)
+	filters = append(filters,
+		fmt.Sprintf(`crop=w=trunc(min(iw\,ih*%s)/2)*2:h=trunc(min(ih\,iw/(%s))/2)*2`, ratio, ratio),
+		"setsar=1",
+	)
+
+	return append(filters, fmt.Sprintf("scale=-2:%d", height))
+}
+
+// DetectCrop finds the black bars at the start of the clip with cropdetect and returns the region inside them,
+// or nil if there aren't any
+func DetectCrop(ctx context.Context, params FfmpegParams) (*CropRect, error) {
+	source := params.Source
+
+	var filters []string
+	if source.Is10Bit() {
+		filters = append(filters, tonemapSoftware(source))
+	}
+
+	// reset=0 makes cropdetect report the largest region seen so far, so the last frame's values cover the whole scan.
+	// The metadata filter prints cropdetect's results to stdout, where they're easier to pick out than from the logs.
+	filters = append(filters,
+		"cropdetect=limit=24:round=2:reset=0",
+		"metadata=mode=print:file="+escapeFilterValue("pipe:1"),
+	)
+
+	stream := ffmpeg.
+		Input(params.URL, ffmpeg.MergeKwArgs([]ffmpeg.KwArgs{params.Input().InputArgs(params.From, ""), {
+			"t":           cropDetectDuration.Seconds(),
+			"hide_banner": "",
+			"loglevel":    "error",
+		}})).
+		Output("-", ffmpeg.KwArgs{
+			"vf": strings.Join(filters, ","),
+			"an": "",
+			"f":  "null",
+		})
+
+	stdout := &bytes.Buffer{}
+	if err := runFfmpeg(ctx, stream.GetArgs(), stdout, "", params.Input().Pipes()...); err != nil {
+		return nil, fmt.Errorf("could not detect black bars: %w", err)
+	}
+
+	rect := &CropRect{}
+	fields := map[string]*int{
+		"lavfi.cropdetect.w": &rect.Width,
+		"lavfi.cropdetect.h": &rect.Height,
+		"lavfi.cropdetect.x": &rect.X,
+		"lavfi.cropdetect.y": &rect.Y,
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if field, known := fields[key]; ok && known {
+			*field, _ = strconv.Atoi(value)
+		}
+	}
+
+	if rect.Width <= 0 || rect.Height <= 0 {
+		return nil, fmt.Errorf("could not detect black bars: no frames were analyzed")
+	}
+
+	if rect.Width == source.Width && rect.Height == source.Height {
+		return nil, nil
+	}
+
+	return rect, nil
+}
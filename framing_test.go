@@ -0,0 +1,114 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFramingFilters(t *testing.T) {
+	letterbox := &CropRect{Width: 1920, Height: 801, X: 0, Y: 140}
+	vertical := AspectRatio{Width: 9, Height: 16}
+	centerCrop := `crop=w=trunc(min(iw\,ih*9/16)/2)*2:h=trunc(min(ih\,iw/(9/16))/2)*2`
+
+	blur := func(w, h string) string {
+		return "split[fg][bg];" +
+			"[bg]scale=" + w + ":" + h + ":force_original_aspect_ratio=increase,crop=" + w + ":" + h + ",boxblur=20[bg];" +
+			"[fg]scale=" + w + ":" + h + ":force_original_aspect_ratio=decrease[fg];" +
+			"[bg][fg]overlay=(W-w)/2:(H-h)/2,setsar=1"
+	}
+
+	tests := []struct {
+		name    string
+		framing Framing
+		source  VideoSource
+		height  int
+		want    []string
+	}{
+		{name: "scale only", source: sdrSource, height: 720, want: []string{"scale=-2:720"}},
+		{
+			name:    "crop",
+			framing: Framing{Crop: letterbox},
+			source:  sdrSource,
+			height:  720,
+			want:    []string{"crop=1920:801:0:140", "scale=-2:720"},
+		},
+		{
+			name:    "center crop",
+			framing: Framing{Aspect: vertical, Mode: FramingModeCrop},
+			source:  sdrSource,
+			height:  1080,
+			want:    []string{centerCrop, "setsar=1", "scale=-2:1080"},
+		},
+		{
+			name:    "crop then center crop",
+			framing: Framing{Crop: letterbox, Aspect: AspectRatio{Width: 1, Height: 1}, Mode: FramingModeCrop},
+			source:  sdrSource,
+			height:  720,
+			want: []string{
+				"crop=1920:801:0:140",
+				`crop=w=trunc(min(iw\,ih*1/1)/2)*2:h=trunc(min(ih\,iw/(1/1))/2)*2`,
+				"setsar=1",
+				"scale=-2:720",
+			},
+		},
+		{
+			name:    "blur",
+			framing: Framing{Aspect: vertical, Mode: FramingModeBlur},
+			source:  sdrSource,
+			height:  1080,
+			want:    []string{blur("608", "1080")},
+		},
+		{
+			name:    "blur odd height",
+			framing: Framing{Aspect: vertical, Mode: FramingModeBlur},
+			source:  sdrSource,
+			height:  721,
+			want:    []string{blur("406", "720")},
+		},
+		{
+			name:    "blur at the cropped height",
+			framing: Framing{Crop: letterbox, Aspect: vertical, Mode: FramingModeBlur},
+			source:  sdrSource,
+			want:    []string{"crop=1920:801:0:140", blur("450", "800")},
+		},
+		{
+			name:    "blur with an unknown source height",
+			framing: Framing{Aspect: vertical, Mode: FramingModeBlur},
+			source:  VideoSource{BitDepth: 8},
+			want:    []string{blur("608", "1080")},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.framing.Filters(tt.source, tt.height); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Filters() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCropRect(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    *CropRect
+		wantErr bool
+	}{
+		{in: "1920:800:0:140", want: &CropRect{Width: 1920, Height: 800, X: 0, Y: 140}},
+		{in: "1920:800:0", wantErr: true},
+		{in: "1920:800:0:-1", wantErr: true},
+		{in: "0:800:0:0", wantErr: true},
+		{in: "w:h:x:y", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseCropRect(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseCropRect(%q) returned %v, want an error: %t", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseCropRect(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
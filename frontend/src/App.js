@@ -70,7 +70,13 @@ function App() {
   }, [setNeedsAuth, setSessions])
 
   const setPlayerPosition = useCallback((startPosition, endPosition) => {
-    setPlayerUrl(`/preview/${selectedSession.ratingKey}/${millisToDuration(startPosition)}/${millisToDuration(endPosition)}?mediaId=${selectedSession.Media[0].Part[0].id}`)
+    // Segments are cached per session on the server so moving the start/end only encodes segments that haven't been seen yet
+    const params = new URLSearchParams({
+      from: millisToDuration(startPosition),
+      to: millisToDuration(endPosition),
+      mediaId: selectedSession.Media[0].id,
+    })
+    setPlayerUrl(`/preview/${selectedSession.ratingKey}/index.m3u8?${params}`)
   }, [selectedSession]);
 
   useEffect(() => {
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/LukeHagar/plexgo/models/operations"
+)
+
+type HDRFormat string
+
+// dolbyVisionBaseLayer matches the base layer in Plex's display title of Dolby Vision streams, e.g. "4K DoVi/HDR10 (HEVC
+// Main 10)", which players without Dolby Vision support fall back to
+var dolbyVisionBaseLayer = regexp.MustCompile(`(?i)(DoVi|Dolby Vision)\s*/\s*(HDR10|HLG|SDR)`)
+
+const (
+	HDRFormatNone        HDRFormat = ""
+	HDRFormatHDR10       HDRFormat = "hdr10"
+	HDRFormatHLG         HDRFormat = "hlg"
+	HDRFormatDolbyVision HDRFormat = "dolby_vision"
+)
+
+// HDRMode determines how 10-bit and HDR sources are encoded
+type HDRMode string
+
+const (
+	// HDRModeTonemap converts the source to SDR 8-bit H.264, which plays everywhere
+	HDRModeTonemap HDRMode = "tonemap"
+	// HDRModeKeep retains the 10-bit color (and HDR metadata) by encoding to HEVC Main 10, or AV1 if that's the codec
+	HDRModeKeep HDRMode = "keep"
+)
+
+func ParseHDRMode(s string) (HDRMode, error) {
+	switch HDRMode(s) {
+	case "":
+		return HDRModeTonemap, nil
+	case HDRModeTonemap, HDRModeKeep:
+		return HDRMode(s), nil
+	default:
+		return "", fmt.Errorf("unknown hdr mode %q", s)
+	}
+}
+
+// VideoSource describes the properties of the source video stream that affect the encoding pipeline
+type VideoSource struct {
+	HDR      HDRFormat
+	BitDepth int
+	// Width and Height are 0 if Plex doesn't know the resolution
+	Width  int
+	Height int
+	// DolbyVisionProfile5 is set for Dolby Vision without a base layer. Its video is stored in Dolby's own color space
+	// and only has the right colors once the Dolby Vision metadata has been applied, which only libplacebo does.
+	DolbyVisionProfile5 bool
+}
+
+func (v VideoSource) IsHDR() bool {
+	return v.HDR != HDRFormatNone
+}
+
+func (v VideoSource) Is10Bit() bool {
+	return v.BitDepth > 8
+}
+
+// Check returns an error if the local ffmpeg build can't convert the source's colors
+func (v VideoSource) Check() error {
+	if v.DolbyVisionProfile5 && !ffmpegHasFilter("libplacebo") {
+		return fmt.Errorf("dolby vision profile 5 video can't be converted without ffmpeg's libplacebo filter")
+	}
+	return nil
+}
+
+// nominalHeight is the height of the 16:9 frame the video fits in, so that a 1920x800 widescreen movie counts as 1080p
+func (v VideoSource) nominalHeight() int {
+	return max(v.Height, v.Width*9/16)
+}
+
+// NewVideoSource inspects the Plex stream metadata of the media's first video stream
+func NewVideoSource(media operations.GetMetadataMedia) VideoSource {
+	source := VideoSource{
+		BitDepth: 8,
+	}
+
+	if media.Width != nil && media.Height != nil {
+		source.Width = *media.Width
+		source.Height = *media.Height
+	}
+
+	if media.VideoProfile != nil && *media.VideoProfile == "main 10" {
+		source.BitDepth = 10
+	}
+
+	stream := videoStream(media)
+	if stream == nil {
+		return source
+	}
+
+	if stream.BitDepth != nil {
+		source.BitDepth = *stream.BitDepth
+	}
+
+	// Plex doesn't expose the Dolby Vision configuration directly, but it does add it to the display title.
+	// Profile 5 is the only one without a base layer, so it's also the only one without HDR10 or HLG signalling.
+	for _, title := range []*string{stream.DisplayTitle, stream.ExtendedDisplayTitle} {
+		if title != nil && (strings.Contains(*title, "Dolby Vision") || strings.Contains(*title, "DoVi")) {
+			source.HDR = HDRFormatDolbyVision
+			trc := deref(stream.ColorTrc)
+			source.DolbyVisionProfile5 = !dolbyVisionBaseLayer.MatchString(*title) &&
+				trc != "smpte2084" && trc != "arib-std-b67"
+			return source
+		}
+	}
+
+	if stream.ColorTrc != nil {
+		switch *stream.ColorTrc {
+		case "smpte2084":
+			source.HDR = HDRFormatHDR10
+		case "arib-std-b67":
+			source.HDR = HDRFormatHLG
+		}
+	}
+
+	return source
+}
+
+func videoStream(media operations.GetMetadataMedia) *operations.Stream {
+	for _, part := range media.Part {
+		for i, stream := range part.Stream {
+			if stream.StreamType != nil && *stream.StreamType == 1 {
+				return &part.Stream[i]
+			}
+		}
+	}
+	return nil
+}
+
+// tonemapSoftware converts software frames from the source to SDR 8-bit yuv420p
+func tonemapSoftware(source VideoSource) string {
+	if !source.IsHDR() {
+		return "format=yuv420p"
+	}
+
+	if source.DolbyVisionProfile5 {
+		// https://ffmpeg.org/ffmpeg-filters.html#libplacebo, which applies the Dolby Vision metadata by default
+		return "libplacebo=colorspace=bt709:color_primaries=bt709:color_trc=bt709:range=tv:tonemapping=auto:format=yuv420p"
+	}
+
+	// https://ffmpeg.org/ffmpeg-filters.html#tonemap-1
+	return "zscale=t=linear:npl=100,format=gbrpf32le,zscale=p=bt709,tonemap=tonemap=hable:desat=0,zscale=t=bt709:m=bt709:r=tv,format=yuv420p"
+}
+
+// tonemapVAAPI converts VAAPI frames from the source to SDR 8-bit nv12 VAAPI frames
+func tonemapVAAPI(source VideoSource) string {
+	if !source.IsHDR() {
+		return "scale_vaapi=format=nv12"
+	}
+
+	// tonemap_vaapi is only implemented by the Intel media driver, and doesn't apply Dolby Vision metadata
+	if ffmpegHasFilter("tonemap_vaapi") && !source.DolbyVisionProfile5 {
+		return "tonemap_vaapi=format=nv12:p=bt709:t=bt709:m=bt709"
+	}
+
+	return "hwdownload,format=p010le," + tonemapSoftware(source) + ",format=nv12,hwupload"
+}
+
+// tonemapCUDA converts CUDA frames from the source to SDR 8-bit CUDA frames
+func tonemapCUDA(source VideoSource) string {
+	if !source.IsHDR() {
+		return "scale_cuda=format=nv12"
+	}
+
+	// tonemap_cuda isn't in upstream ffmpeg but is included in some distributions (e.g. jellyfin-ffmpeg), and doesn't
+	// apply Dolby Vision metadata
+	if ffmpegHasFilter("tonemap_cuda") && !source.DolbyVisionProfile5 {
+		return "tonemap_cuda=tonemap=hable:format=nv12:p=bt709:t=bt709:m=bt709"
+	}
+
+	// hwupload uses the device the frames were decoded on, unlike hwupload_cuda which always uses the first GPU
+	return "hwdownload,format=p010le," + tonemapSoftware(source) + ",hwupload"
+}
+
+// tonemapQSV converts QSV frames from the source to SDR 8-bit nv12 QSV frames
+func tonemapQSV(source VideoSource) string {
+	if !source.IsHDR() {
+		return "scale_qsv=format=nv12"
+	}
+
+	return "hwdownload,format=p010le," + tonemapSoftware(source) + ",format=nv12,hwupload=extra_hw_frames=64"
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/LukeHagar/plexgo"
+	"github.com/LukeHagar/plexgo/models/operations"
+)
+
+func TestNewVideoSourceDolbyVision(t *testing.T) {
+	tests := []struct {
+		title        string
+		colorTrc     string
+		wantHDR      HDRFormat
+		wantProfile5 bool
+	}{
+		{title: "4K DoVi/HDR10 (HEVC Main 10)", colorTrc: "smpte2084", wantHDR: HDRFormatDolbyVision},
+		{title: "4K DoVi/HLG (HEVC Main 10)", colorTrc: "arib-std-b67", wantHDR: HDRFormatDolbyVision},
+		{title: "1080p DoVi/SDR (HEVC Main 10)", colorTrc: "bt709", wantHDR: HDRFormatDolbyVision},
+		{title: "4K DoVi (HEVC Main 10)", wantHDR: HDRFormatDolbyVision, wantProfile5: true},
+		{title: "4K Dolby Vision (HEVC Main 10)", colorTrc: "bt709", wantHDR: HDRFormatDolbyVision, wantProfile5: true},
+		// The base layer is missing from the title, but the HDR10 signalling shows that there is one
+		{title: "4K DoVi (HEVC Main 10)", colorTrc: "smpte2084", wantHDR: HDRFormatDolbyVision},
+		{title: "4K HDR10 (HEVC Main 10)", colorTrc: "smpte2084", wantHDR: HDRFormatHDR10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.title+" "+tt.colorTrc, func(t *testing.T) {
+			stream := operations.Stream{
+				StreamType:   plexgo.Int(1),
+				BitDepth:     plexgo.Int(10),
+				DisplayTitle: plexgo.String(tt.title),
+			}
+			if tt.colorTrc != "" {
+				stream.ColorTrc = plexgo.String(tt.colorTrc)
+			}
+			key := "/library/parts/1/file.mkv"
+			media := operations.GetMetadataMedia{Part: []operations.GetMetadataPart{{Key: &key, Stream: []operations.Stream{stream}}}}
+
+			source := NewVideoSource(media)
+			if source.HDR != tt.wantHDR || source.DolbyVisionProfile5 != tt.wantProfile5 {
+				t.Errorf("NewVideoSource() = %s, profile 5 %v, want %s, profile 5 %v",
+					source.HDR, source.DolbyVisionProfile5, tt.wantHDR, tt.wantProfile5)
+			}
+		})
+	}
+}
+
+func TestVideoSourceCheck(t *testing.T) {
+	withFfmpegFilters(t)
+	if err := dv5Source.Check(); err == nil {
+		t.Error("Check() of Dolby Vision profile 5 without libplacebo = nil, want an error")
+	}
+	if err := hdr10Source.Check(); err != nil {
+		t.Errorf("Check() of HDR10 returned an error: %v", err)
+	}
+
+	withFfmpegFilters(t, "libplacebo")
+	if err := dv5Source.Check(); err != nil {
+		t.Errorf("Check() of Dolby Vision profile 5 with libplacebo returned an error: %v", err)
+	}
+}
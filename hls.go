@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// hlsSegmentDuration is the length of each preview segment. Segments are aligned to the start of the media
+	// so that they can be reused when the preview window changes.
+	hlsSegmentDuration = 4 * time.Second
+	// hlsCacheTTL is how long an HLS preview's segments are kept after they were last requested
+	hlsCacheTTL = 30 * time.Minute
+)
+
+// HLSCache keeps the segments encoded for each HLS preview session on disk so that they're only encoded once
+type HLSCache struct {
+	dir     string
+	mu      sync.Mutex
+	entries map[string]*hlsEntry
+}
+
+type hlsEntry struct {
+	dir      string
+	source   MediaSource
+	lastUsed time.Time
+	segments map[int]*hlsSegment
+}
+
+type hlsSegment struct {
+	done chan struct{}
+	path string
+	err  error
+}
+
+func NewHLSCache(dir string) *HLSCache {
+	cache := &HLSCache{
+		dir:     dir,
+		entries: map[string]*hlsEntry{},
+	}
+
+	go cache.expire()
+
+	return cache
+}
+
+func hlsKey(sessionID, ratingKey string, mediaID int) string {
+	return fmt.Sprintf("%s/%s-%d", sessionID, ratingKey, mediaID)
+}
+
+// Source returns the preview source cached for the key, if any
+func (c *HLSCache) Source(key string) (MediaSource, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return MediaSource{}, false
+	}
+
+	entry.lastUsed = time.Now()
+
+	return entry.source, true
+}
+
+// SetSource creates the cache entry for the key if it doesn't exist yet
+func (c *HLSCache) SetSource(key string, source MediaSource) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if entry, ok := c.entries[key]; ok {
+		entry.lastUsed = time.Now()
+		return
+	}
+
+	c.entries[key] = &hlsEntry{
+		dir:      filepath.Join(c.dir, filepath.FromSlash(key)),
+		source:   source,
+		lastUsed: time.Now(),
+		segments: map[int]*hlsSegment{},
+	}
+}
+
+// Segment returns the path to the encoded segment, calling encode to produce it if it hasn't been yet.
+// Concurrent requests for the same segment wait for the first encode instead of starting another, or until their
+// context is done.
+func (c *HLSCache) Segment(ctx context.Context, key string, index int, encode func(dir, filename string) (string, error)) (string, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if !ok {
+		c.mu.Unlock()
+		return "", fmt.Errorf("preview session not found")
+	}
+
+	entry.lastUsed = time.Now()
+
+	segment, ok := entry.segments[index]
+	if ok {
+		c.mu.Unlock()
+		select {
+		case <-segment.done:
+			return segment.path, segment.err
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+
+	segment = &hlsSegment{done: make(chan struct{})}
+	entry.segments[index] = segment
+	c.mu.Unlock()
+
+	if err := os.MkdirAll(entry.dir, 0o755); err != nil {
+		segment.err = err
+	} else {
+		segment.path, segment.err = encode(entry.dir, strconv.Itoa(index)+".ts")
+	}
+
+	if segment.err != nil {
+		// Allow the segment to be retried
+		c.mu.Lock()
+		delete(entry.segments, index)
+		c.mu.Unlock()
+	}
+
+	close(segment.done)
+
+	return segment.path, segment.err
+}
+
+// Close removes all cached segments. Entries aren't persisted so the segments can't be used after a restart.
+func (c *HLSCache) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = map[string]*hlsEntry{}
+
+	return os.RemoveAll(c.dir)
+}
+
+func (c *HLSCache) expire() {
+	for range time.Tick(time.Minute) {
+		c.mu.Lock()
+		for key, entry := range c.entries {
+			if time.Since(entry.lastUsed) < hlsCacheTTL {
+				continue
+			}
+			delete(c.entries, key)
+			if err := os.RemoveAll(entry.dir); err != nil {
+				log.Printf("could not remove expired preview segments: %v", err)
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// HLSPlaylist builds a VOD playlist of the segments covering the from-to window.
+// Playback starts at from, which may be part way through the first segment.
+func HLSPlaylist(from, to, duration time.Duration, segmentURL func(index int) string) string {
+	if to <= 0 || to > duration {
+		to = duration
+	}
+	if from >= to {
+		from = 0
+	}
+
+	first := int(from / hlsSegmentDuration)
+	last := int(math.Ceil(float64(to)/float64(hlsSegmentDuration))) - 1
+
+	b := &strings.Builder{}
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-VERSION:6\n")
+	b.WriteString("#EXT-X-PLAYLIST-TYPE:VOD\n")
+	fmt.Fprintf(b, "#EXT-X-TARGETDURATION:%d\n", int(hlsSegmentDuration.Seconds()))
+	fmt.Fprintf(b, "#EXT-X-MEDIA-SEQUENCE:%d\n", first)
+	fmt.Fprintf(b, "#EXT-X-START:TIME-OFFSET=%.3f,PRECISE=YES\n", (from - time.Duration(first)*hlsSegmentDuration).Seconds())
+
+	for i := first; i <= last; i++ {
+		segmentDuration := hlsSegmentDuration
+		if end := time.Duration(i+1) * hlsSegmentDuration; end > duration {
+			segmentDuration -= end - duration
+		}
+		fmt.Fprintf(b, "#EXTINF:%.3f,\n", segmentDuration.Seconds())
+		b.WriteString(segmentURL(i) + "\n")
+	}
+
+	b.WriteString("#EXT-X-ENDLIST\n")
+
+	return b.String()
+}
+
+// PreviewPlaylist registers an HLS preview for the session and returns its playlist and the ID of the version it
+// previews
+func (a *Application) PreviewPlaylist(ctx context.Context, sessionID, ratingKeyStr, mediaIdStr string, from, to time.Duration) (string, int, error) {
+	source, err := a.MediaSource(ctx, ratingKeyStr, mediaIdStr)
+	if err != nil {
+		return "", 0, err
+	}
+
+	a.hls.SetSource(hlsKey(sessionID, ratingKeyStr, source.MediaID), *source)
+
+	return HLSPlaylist(from, to, source.Duration, func(index int) string {
+		return fmt.Sprintf("segment/%d.ts?mediaId=%d", index, source.MediaID)
+	}), source.MediaID, nil
+}
+
+// PreviewSegment returns the path to an encoded HLS preview segment for a playlist previously returned by
+// PreviewPlaylist, encoding it if necessary
+func (a *Application) PreviewSegment(ctx context.Context, sessionID, ratingKeyStr string, mediaID, index int) (string, error) {
+	key := hlsKey(sessionID, ratingKeyStr, mediaID)
+
+	source, ok := a.hls.Source(key)
+	if !ok {
+		return "", fmt.Errorf("preview session not found")
+	}
+
+	start := time.Duration(index) * hlsSegmentDuration
+	if index < 0 || start >= source.Duration {
+		return "", fmt.Errorf("segment out of range")
+	}
+
+	return a.hls.Segment(ctx, key, index, func(dir, filename string) (string, error) {
+		from := FormatTimestamp(start)
+		to := FormatTimestamp(min(start+hlsSegmentDuration, source.Duration))
+
+		input, err := a.partInput(source.Parts, from, to)
+		if err != nil {
+			return "", err
+		}
+
+		params := FfmpegParams{
+			URL:      input.URL,
+			Offset:   input.Offset,
+			List:     input.List,
+			From:     from,
+			To:       to,
+			Dir:      dir,
+			Filename: filename,
+			Codec:    a.capabilities.Usable(a.config.Ffmpeg.Codec.H264()),
+			Source:   source.Source,
+		}
+
+		ctx, cancel := a.jobContext(ctx)
+		defer cancel()
+
+		params.Device = a.devices.Acquire(params.Codec)
+		defer a.devices.Release(params.Device)
+
+		return DoFfmpegPreviewSegment(ctx, params)
+	})
+}
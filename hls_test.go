@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestHLSCacheSegmentWaitCanceled(t *testing.T) {
+	c := NewHLSCache(t.TempDir())
+	c.SetSource("session/1-1", MediaSource{})
+
+	started, release := make(chan struct{}), make(chan struct{})
+	encoded := make(chan error)
+	go func() {
+		_, err := c.Segment(context.Background(), "session/1-1", 0, func(dir, filename string) (string, error) {
+			close(started)
+			<-release
+			return dir + "/" + filename, nil
+		})
+		encoded <- err
+	}()
+	<-started
+
+	// A second request for the segment waits for the first encode, but gives up when its context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.Segment(ctx, "session/1-1", 0, func(dir, filename string) (string, error) {
+		t.Error("segment was encoded twice")
+		return "", nil
+	}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Segment returned %v, want %v", err, context.Canceled)
+	}
+
+	close(release)
+	if err := <-encoded; err != nil {
+		t.Errorf("first encode returned an error: %v", err)
+	}
+}
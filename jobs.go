@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// Jobs tracks in-flight encodes so that shutdown can let them finish
+type Jobs struct {
+	mu       sync.Mutex
+	draining bool
+	wg       sync.WaitGroup
+	ctx      context.Context
+	cancel   context.CancelCauseFunc
+	// backgroundCtx is cancelled as soon as draining starts
+	backgroundCtx    context.Context
+	cancelBackground context.CancelCauseFunc
+}
+
+func NewJobs() *Jobs {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	backgroundCtx, cancelBackground := context.WithCancelCause(ctx)
+	return &Jobs{
+		ctx:              ctx,
+		cancel:           cancel,
+		backgroundCtx:    backgroundCtx,
+		cancelBackground: cancelBackground,
+	}
+}
+
+// Start registers a new job, which must call done once it's finished.
+// ok is false once Drain has been called, in which case the job must not run.
+func (j *Jobs) Start() (done func(), ok bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.draining {
+		return nil, false
+	}
+
+	j.wg.Add(1)
+
+	return j.wg.Done, true
+}
+
+// StartBackground registers a job that isn't tied to a request, such as indexing a library. Background jobs can run
+// for much longer than the shutdown grace period, so ctx is cancelled as soon as Drain is called rather than when
+// the grace period runs out. Drain still waits for the job to call done.
+func (j *Jobs) StartBackground() (ctx context.Context, done func(), ok bool) {
+	done, ok = j.Start()
+	if !ok {
+		return nil, nil, false
+	}
+	return j.backgroundCtx, done, true
+}
+
+// Context is cancelled when running jobs didn't finish before the Drain deadline
+func (j *Jobs) Context() context.Context {
+	return j.ctx
+}
+
+// Drain stops new jobs from starting and waits for running jobs to finish.
+// If ctx is done first, the running jobs are cancelled and Drain waits for them to stop.
+func (j *Jobs) Drain(ctx context.Context) error {
+	j.mu.Lock()
+	j.draining = true
+	j.mu.Unlock()
+
+	j.cancelBackground(errServerShutdown)
+
+	finished := make(chan struct{})
+	go func() {
+		j.wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		j.cancel(errServerShutdown)
+		<-finished
+		return ctx.Err()
+	}
+}
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/spf13/viper"
 )
@@ -11,13 +16,49 @@ type Config struct {
 	Plex struct {
 		Host  string `mapstructure:"host"`
 		Token string `mapstructure:"token"`
+		// PathMappings translate the paths of media files on the Plex server to where they're mounted locally, so
+		// that they can be read directly rather than over HTTP
+		PathMappings []PathMapping `mapstructure:"path_mappings"`
 	}
 	API struct {
 		ListenAddr string `mapstructure:"listen_addr"`
 		Domain     string `mapstructure:"domain"`
+		// ShutdownGracePeriod is how long running encodes are given to finish when shutting down
+		ShutdownGracePeriod time.Duration `mapstructure:"shutdown_grace_period"`
 	}
 	Ffmpeg struct {
-		Codec Codec `mapstructure:"codec"`
+		Codec Codec   `mapstructure:"codec"`
+		HDR   HDRMode `mapstructure:"hdr"`
+		// Devices are keyed by codec or hardware acceleration method (vaapi, cuda, qsv)
+		Devices map[string][]string `mapstructure:"devices"`
+		// Timeout limits how long a single encode can run for
+		Timeout time.Duration `mapstructure:"timeout"`
+	}
+	Overlay struct {
+		// Font is the font file that text overlays are drawn with
+		Font      string `mapstructure:"font"`
+		Watermark struct {
+			Image    string          `mapstructure:"image"`
+			Position OverlayPosition `mapstructure:"position"`
+			Opacity  float64         `mapstructure:"opacity"`
+			Scale    float64         `mapstructure:"scale"`
+			// Always adds the watermark to clips unless they opt out
+			Always bool `mapstructure:"always"`
+		}
+	}
+	Media struct {
+		// Selection is the order of preferences used to pick the version of an item when no media ID is requested
+		Selection []MediaPreference `mapstructure:"selection"`
+		// TargetHeight is the height versions are compared against when the requested height is the source's
+		TargetHeight int `mapstructure:"target_height"`
+	}
+	Clip struct {
+		// Filename is a text/template that clips are named with
+		Filename string `mapstructure:"filename"`
+	}
+	Quotes struct {
+		// Database is the SQLite file that the subtitle search index is stored in
+		Database string `mapstructure:"database"`
 	}
 }
 
@@ -25,6 +66,11 @@ func loadConfig() (*Config, error) {
 	var cfg Config
 	viper.SetConfigName("config")
 	viper.AddConfigPath(".")
+	viper.SetDefault("api.shutdown_grace_period", 30*time.Second)
+	viper.SetDefault("quotes.database", "./quotes.sqlite3")
+	viper.SetDefault("overlay.watermark.opacity", 0.8)
+	viper.SetDefault("overlay.watermark.scale", 0.1)
+	viper.SetDefault("media.target_height", DefaultTargetHeight)
 	if err := viper.ReadInConfig(); err != nil {
 		return nil, fmt.Errorf("reading config file: %w", err)
 	}
@@ -33,6 +79,43 @@ func loadConfig() (*Config, error) {
 		return nil, fmt.Errorf("unmarshal config file: %w", err)
 	}
 
+	cfg.Plex.PathMappings, err = ParsePathMappings(cfg.Plex.PathMappings)
+	if err != nil {
+		return nil, fmt.Errorf("invalid plex config: %w", err)
+	}
+
+	if cfg.Ffmpeg.Codec == "" {
+		cfg.Ffmpeg.Codec = CodecLibx264
+	}
+
+	cfg.Ffmpeg.Codec, err = ParseCodec(string(cfg.Ffmpeg.Codec))
+	if err != nil {
+		return nil, fmt.Errorf("invalid ffmpeg config: %w", err)
+	}
+
+	cfg.Ffmpeg.HDR, err = ParseHDRMode(string(cfg.Ffmpeg.HDR))
+	if err != nil {
+		return nil, fmt.Errorf("invalid ffmpeg config: %w", err)
+	}
+
+	cfg.Overlay.Watermark.Position, err = ParseWatermarkPosition(string(cfg.Overlay.Watermark.Position))
+	if err != nil {
+		return nil, fmt.Errorf("invalid overlay config: %w", err)
+	}
+
+	cfg.Media.Selection, err = ParseMediaSelection(cfg.Media.Selection)
+	if err != nil {
+		return nil, fmt.Errorf("invalid media config: %w", err)
+	}
+
+	if cfg.Media.TargetHeight <= 0 {
+		return nil, fmt.Errorf("invalid media config: target_height must be positive")
+	}
+
+	if _, err := ParseFilenameTemplate(cfg.Clip.Filename); err != nil {
+		return nil, fmt.Errorf("invalid clip config: %w", err)
+	}
+
 	return &cfg, nil
 }
 
@@ -52,5 +135,28 @@ func main() {
 		log.Fatal(err)
 	}
 
-	log.Fatal(api.Start())
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		if err := api.Start(); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+
+	log.Printf("shutting down, waiting up to %s for running encodes to finish", cfg.API.ShutdownGracePeriod)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.API.ShutdownGracePeriod)
+	defer cancel()
+
+	if err := api.Shutdown(shutdownCtx); err != nil {
+		log.Print(err)
+	}
+
+	if err := app.Close(); err != nil {
+		log.Print(err)
+	}
 }
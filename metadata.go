@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/LukeHagar/plexgo/models/operations"
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+// coverArtSize is the size of the box that posters are resized to fit in before they're embedded
+const coverArtSize = 1000
+
+// Plex metadata types that can be clipped. Videos in photo libraries and extras such as trailers are clips.
+const (
+	MediaTypeMovie   = "movie"
+	MediaTypeEpisode = "episode"
+	MediaTypeTrack   = "track"
+	MediaTypeClip    = "clip"
+)
+
+// checkMediaType returns an error for items that can't be clipped, such as shows, albums and photos
+func checkMediaType(metadata operations.GetMetadataMetadata) error {
+	if metadata.Type == nil {
+		return nil
+	}
+
+	switch *metadata.Type {
+	case MediaTypeMovie, MediaTypeEpisode, MediaTypeTrack, MediaTypeClip:
+		return nil
+	default:
+		return fmt.Errorf("%s items can't be clipped", *metadata.Type)
+	}
+}
+
+// IsAudio reports whether the item is music, which has no video to clip
+func (m FfmpegParamsMetadata) IsAudio() bool {
+	return m.Type == MediaTypeTrack
+}
+
+func deref[T any](v *T) T {
+	if v == nil {
+		var zero T
+		return zero
+	}
+	return *v
+}
+
+type plexShowResponse struct {
+	MediaContainer struct {
+		Metadata []struct {
+			GrandparentRatingKey string `json:"grandparentRatingKey"`
+			Studio               string `json:"studio"`
+			Thumb                string `json:"thumb"`
+		} `json:"Metadata"`
+	} `json:"MediaContainer"`
+}
+
+// Show is the information about an episode's show that isn't included in the episode's metadata
+type Show struct {
+	// Network is the show's studio
+	Network string
+	Poster  string
+}
+
+// Show looks up the network and poster of an episode's show.
+// The Plex API client doesn't include the show's rating key in the episode's metadata so it's requested separately.
+func (a *Application) Show(ctx context.Context, ratingKeyStr string) (*Show, error) {
+	if _, err := strconv.Atoi(ratingKeyStr); err != nil {
+		return nil, fmt.Errorf("could not parse rating key: %w", err)
+	}
+
+	var episode plexShowResponse
+	if err := a.plexGet(ctx, "/library/metadata/"+ratingKeyStr, &episode); err != nil {
+		return nil, fmt.Errorf("could not get episode: %w", err)
+	}
+
+	if len(episode.MediaContainer.Metadata) == 0 || episode.MediaContainer.Metadata[0].GrandparentRatingKey == "" {
+		return nil, fmt.Errorf("could not find show for rating key")
+	}
+
+	var show plexShowResponse
+	if err := a.plexGet(ctx, "/library/metadata/"+episode.MediaContainer.Metadata[0].GrandparentRatingKey, &show); err != nil {
+		return nil, fmt.Errorf("could not get show: %w", err)
+	}
+
+	if len(show.MediaContainer.Metadata) == 0 {
+		return nil, fmt.Errorf("could not find show for rating key")
+	}
+
+	return &Show{
+		Network: show.MediaContainer.Metadata[0].Studio,
+		Poster:  show.MediaContainer.Metadata[0].Thumb,
+	}, nil
+}
+
+// coverArt downloads the image at the thumb path to a temporary file in dir and returns its path
+func (a *Application) coverArt(ctx context.Context, thumb string, dir string) (string, error) {
+	if thumb == "" {
+		return "", fmt.Errorf("item has no poster")
+	}
+
+	resp, err := a.plexAdmin.Server.GetResizedPhoto(ctx, operations.GetResizedPhotoRequest{
+		Width:  coverArtSize,
+		Height: coverArtSize,
+		URL:    thumb,
+	})
+	if err != nil {
+		return "", fmt.Errorf("could not get poster: %w", err)
+	}
+
+	defer resp.RawResponse.Body.Close()
+
+	f, err := os.CreateTemp(dir, "cover-*.jpg")
+	if err != nil {
+		return "", err
+	}
+
+	_, err = io.Copy(f, resp.RawResponse.Body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return "", fmt.Errorf("could not download poster: %w", err)
+	}
+
+	return f.Name(), nil
+}
+
+// AttachCoverArt embeds the image as the cover art of the MP4, M4A or MP3 file at path.
+// The streams are copied into a new file which then replaces the original.
+// ffmpeg only writes cover art to MP4 files with the iTunes tags, which can't hold the custom tags that video clips are
+// written with, so the cover is added to video clips without ffmpeg.
+func AttachCoverArt(ctx context.Context, path, imagePath string, format AudioFormat) error {
+	if format == AudioFormatNone {
+		if err := attachMP4Cover(path, imagePath); err != nil {
+			return fmt.Errorf("could not attach cover art: %w", err)
+		}
+		return nil
+	}
+
+	output := ffmpeg.KwArgs{
+		"map":          []string{"0", "1"},
+		"c":            "copy",
+		"map_metadata": 0,
+		"map_chapters": -1,
+		"hide_banner":  "",
+		"loglevel":     "error",
+	}
+
+	switch format {
+	case AudioFormatM4A:
+		output["disposition:v:0"] = "attached_pic"
+		output["movflags"] = "+faststart"
+		output["f"] = "mp4"
+	case AudioFormatMP3:
+		output["disposition:v:0"] = "attached_pic"
+		output["id3v2_version"] = 3
+		output["f"] = "mp3"
+	default:
+		return fmt.Errorf("cover art can't be attached to %s files", format)
+	}
+
+	target := filepath.Join(filepath.Dir(path), "cover-"+filepath.Base(path))
+	args := []string{"-i", path, "-i", imagePath}
+	args = append(args, ffmpeg.ConvertKwargsToCmdLineArgs(output)...)
+	args = append(args, "-y", target)
+
+	if err := runFfmpeg(ctx, args, nil, target); err != nil {
+		return fmt.Errorf("could not attach cover art: %w", err)
+	}
+
+	return os.Rename(target, path)
+}
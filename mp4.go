@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+// Cover art is written as an iTunes covr item, with the type of the image in its data box
+const (
+	mp4DataTypeJPEG = 13
+	mp4DataTypePNG  = 14
+)
+
+// mp4Box is a box in an MP4 file, Start and End are the offsets of its header and of the byte after it
+type mp4Box struct {
+	Type       string
+	Start, End int64
+	HeaderSize int64
+}
+
+// Payload returns the contents of the box in data, which the box's offsets are relative to
+func (b mp4Box) Payload(data []byte) []byte {
+	return data[b.Start+b.HeaderSize : b.End]
+}
+
+// readMP4Box reads the header of the box at offset, which has to end by end
+func readMP4Box(r io.ReaderAt, offset, end int64) (mp4Box, error) {
+	header := make([]byte, 16)
+	n, err := r.ReadAt(header, offset)
+	if n < 8 {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return mp4Box{}, fmt.Errorf("could not read box at %d: %w", offset, err)
+	}
+
+	box := mp4Box{Type: string(header[4:8]), Start: offset, HeaderSize: 8}
+	size := int64(binary.BigEndian.Uint32(header))
+
+	switch size {
+	case 0:
+		// The box extends to the end of the file
+		size = end - offset
+	case 1:
+		if n < 16 {
+			return mp4Box{}, fmt.Errorf("could not read size of box at %d: %w", offset, io.ErrUnexpectedEOF)
+		}
+		size = int64(binary.BigEndian.Uint64(header[8:]))
+		box.HeaderSize = 16
+	}
+
+	if size < box.HeaderSize || size > end-offset {
+		return mp4Box{}, fmt.Errorf("box %q at %d has an invalid size", box.Type, offset)
+	}
+	box.End = offset + size
+
+	return box, nil
+}
+
+// readMP4Boxes reads the headers of the boxes between start and end
+func readMP4Boxes(r io.ReaderAt, start, end int64) ([]mp4Box, error) {
+	var boxes []mp4Box
+	for offset := start; offset < end; {
+		box, err := readMP4Box(r, offset, end)
+		if err != nil {
+			return nil, err
+		}
+		boxes = append(boxes, box)
+		offset = box.End
+	}
+
+	return boxes, nil
+}
+
+// newMP4Box returns a box with the contents
+func newMP4Box(boxType string, contents ...[]byte) []byte {
+	size := 8
+	for _, c := range contents {
+		size += len(c)
+	}
+
+	b := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(b, uint32(size))
+	copy(b[4:], boxType)
+	for _, c := range contents {
+		b = append(b, c...)
+	}
+
+	return b
+}
+
+// mp4CoverMeta returns an iTunes meta box that holds just the image as the cover art
+func mp4CoverMeta(image []byte) []byte {
+	dataType := uint32(mp4DataTypeJPEG)
+	if bytes.HasPrefix(image, []byte("\x89PNG")) {
+		dataType = mp4DataTypePNG
+	}
+
+	// The data box starts with the type of the value and its locale
+	dataHeader := make([]byte, 8)
+	binary.BigEndian.PutUint32(dataHeader, dataType)
+
+	// meta and hdlr are full boxes, with a version and flags before their contents
+	handler := []byte("\x00\x00\x00\x00\x00\x00\x00\x00mdirappl\x00\x00\x00\x00\x00\x00\x00\x00\x00")
+
+	return newMP4Box("meta",
+		[]byte{0, 0, 0, 0},
+		newMP4Box("hdlr", handler),
+		newMP4Box("ilst", newMP4Box("covr", newMP4Box("data", dataHeader, image))),
+	)
+}
+
+// addMP4Cover returns the moov box with the cover art added to its udta box. The iTunes meta box goes before any
+// others in udta, such as the one that holds the custom tags, so that it's read before their keys are.
+func addMP4Cover(moov []byte, image []byte) ([]byte, error) {
+	r := bytes.NewReader(moov)
+	box, err := readMP4Box(r, 0, int64(len(moov)))
+	if err != nil {
+		return nil, err
+	}
+
+	children, err := readMP4Boxes(r, box.HeaderSize, box.End)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := mp4CoverMeta(image)
+
+	var contents [][]byte
+	hasUdta := false
+	for _, child := range children {
+		raw := moov[child.Start:child.End]
+		if child.Type == "udta" && !hasUdta {
+			hasUdta = true
+			raw = newMP4Box("udta", meta, child.Payload(moov))
+		}
+		contents = append(contents, raw)
+	}
+	if !hasUdta {
+		contents = append(contents, newMP4Box("udta", meta))
+	}
+
+	return newMP4Box("moov", contents...), nil
+}
+
+// shiftMP4ChunkOffsets adds delta to the chunk offsets of the tracks in the moov box, which point into the file
+func shiftMP4ChunkOffsets(moov []byte, delta int64) error {
+	r := bytes.NewReader(moov)
+
+	var shift func(start, end int64) error
+	shift = func(start, end int64) error {
+		boxes, err := readMP4Boxes(r, start, end)
+		if err != nil {
+			return err
+		}
+
+		for _, box := range boxes {
+			switch box.Type {
+			case "moov", "trak", "mdia", "minf", "stbl":
+				if err := shift(box.Start+box.HeaderSize, box.End); err != nil {
+					return err
+				}
+			case "stco", "co64":
+				payload := box.Payload(moov)
+				if len(payload) < 8 {
+					return fmt.Errorf("%s box is too short", box.Type)
+				}
+
+				entrySize := 4
+				if box.Type == "co64" {
+					entrySize = 8
+				}
+
+				count := int(binary.BigEndian.Uint32(payload[4:]))
+				entries := payload[8:]
+				if count > len(entries)/entrySize {
+					return fmt.Errorf("%s box is too short for its %d entries", box.Type, count)
+				}
+
+				for i := 0; i < count; i++ {
+					entry := entries[i*entrySize:]
+					if entrySize == 4 {
+						offset := int64(binary.BigEndian.Uint32(entry)) + delta
+						if offset < 0 || offset > math.MaxUint32 {
+							return fmt.Errorf("chunk offset %d doesn't fit in an stco box", offset)
+						}
+						binary.BigEndian.PutUint32(entry, uint32(offset))
+					} else {
+						binary.BigEndian.PutUint64(entry, uint64(int64(binary.BigEndian.Uint64(entry))+delta))
+					}
+				}
+			default:
+			}
+		}
+
+		return nil
+	}
+
+	return shift(0, int64(len(moov)))
+}
+
+// attachMP4Cover embeds the image as the cover art of the MP4 file at path, keeping the tags that are already in it.
+// The file is rewritten with the cover added to its moov box, and the chunk offsets are moved along with the media
+// when the moov box comes first.
+func attachMP4Cover(path, imagePath string) error {
+	image, err := os.ReadFile(imagePath)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	boxes, err := readMP4Boxes(f, 0, info.Size())
+	if err != nil {
+		return err
+	}
+
+	moovIndex, mdatIndex := -1, -1
+	for i, box := range boxes {
+		switch {
+		case box.Type == "moov" && moovIndex < 0:
+			moovIndex = i
+		case box.Type == "mdat" && mdatIndex < 0:
+			mdatIndex = i
+		default:
+		}
+	}
+	if moovIndex < 0 {
+		return fmt.Errorf("%s has no moov box", filepath.Base(path))
+	}
+	moovBox := boxes[moovIndex]
+
+	moov := make([]byte, moovBox.End-moovBox.Start)
+	if _, err := f.ReadAt(moov, moovBox.Start); err != nil {
+		return err
+	}
+
+	newMoov, err := addMP4Cover(moov, image)
+	if err != nil {
+		return err
+	}
+
+	// The media only moves when it comes after the moov box, as it does in files written with faststart
+	if mdatIndex > moovIndex {
+		if err := shiftMP4ChunkOffsets(newMoov, int64(len(newMoov)-len(moov))); err != nil {
+			return err
+		}
+	}
+
+	out, err := os.CreateTemp(filepath.Dir(path), "cover-*"+filepath.Ext(path))
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, io.NewSectionReader(f, 0, moovBox.Start))
+	if err == nil {
+		_, err = out.Write(newMoov)
+	}
+	if err == nil {
+		_, err = io.Copy(out, io.NewSectionReader(f, moovBox.End, info.Size()-moovBox.End))
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(out.Name())
+		return err
+	}
+
+	return os.Rename(out.Name(), path)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testMP4 returns an MP4 file with two chunks of media, the stco box points at them
+func testMP4(t *testing.T, faststart, withUdta bool) ([]byte, [][]byte) {
+	t.Helper()
+
+	chunks := [][]byte{[]byte("first chunk"), []byte("second chunk")}
+	ftyp := newMP4Box("ftyp", []byte("isom\x00\x00\x02\x00isomiso2mp41"))
+	mdat := newMP4Box("mdat", bytes.Join(chunks, nil))
+
+	moov := func(mdatStart int) []byte {
+		stco := make([]byte, 8+4*len(chunks))
+		binary.BigEndian.PutUint32(stco[4:], uint32(len(chunks)))
+		offset := mdatStart + 8
+		for i, chunk := range chunks {
+			binary.BigEndian.PutUint32(stco[8+4*i:], uint32(offset))
+			offset += len(chunk)
+		}
+
+		contents := [][]byte{
+			newMP4Box("mvhd", make([]byte, 100)),
+			newMP4Box("trak", newMP4Box("mdia", newMP4Box("minf", newMP4Box("stbl", newMP4Box("stco", stco))))),
+		}
+		if withUdta {
+			contents = append(contents, newMP4Box("udta", newMP4Box("meta", []byte("\x00\x00\x00\x00custom tags"))))
+		}
+		return newMP4Box("moov", contents...)
+	}
+
+	if faststart {
+		// The moov box's size doesn't depend on the offsets
+		return bytes.Join([][]byte{ftyp, moov(len(ftyp) + len(moov(0))), mdat}, nil), chunks
+	}
+	return bytes.Join([][]byte{ftyp, mdat, moov(len(ftyp))}, nil), chunks
+}
+
+// findMP4Box returns the first box in data that's at the path of box types
+func findMP4Box(t *testing.T, data []byte, path ...string) mp4Box {
+	t.Helper()
+
+	r := bytes.NewReader(data)
+	start, end := int64(0), int64(len(data))
+	var found mp4Box
+
+	for _, boxType := range path {
+		boxes, err := readMP4Boxes(r, start, end)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ok := false
+		for _, box := range boxes {
+			if box.Type == boxType {
+				found, ok = box, true
+				break
+			}
+		}
+		if !ok {
+			t.Fatalf("box %v not found", path)
+		}
+
+		start, end = found.Start+found.HeaderSize, found.End
+		if boxType == "meta" {
+			// meta is a full box, its children come after the version and flags
+			start += 4
+		}
+	}
+
+	return found
+}
+
+func TestAttachMP4Cover(t *testing.T) {
+	image := []byte("\xff\xd8\xff\xe0 not really a jpeg")
+
+	tests := []struct {
+		name      string
+		faststart bool
+		withUdta  bool
+	}{
+		{name: "faststart", faststart: true, withUdta: true},
+		{name: "moov at the end", faststart: false, withUdta: true},
+		{name: "no udta", faststart: true, withUdta: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "clip.mp4")
+			imagePath := filepath.Join(dir, "cover.jpg")
+
+			file, chunks := testMP4(t, tt.faststart, tt.withUdta)
+			if err := os.WriteFile(path, file, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(imagePath, image, 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := attachMP4Cover(path, imagePath); err != nil {
+				t.Fatalf("attachMP4Cover returned an error: %v", err)
+			}
+
+			got, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			data := findMP4Box(t, got, "moov", "udta", "meta", "ilst", "covr", "data").Payload(got)
+			if dataType := binary.BigEndian.Uint32(data); dataType != mp4DataTypeJPEG {
+				t.Errorf("cover data type = %d, want %d", dataType, mp4DataTypeJPEG)
+			}
+			if !bytes.Equal(data[8:], image) {
+				t.Errorf("cover = %q, want %q", data[8:], image)
+			}
+
+			// The cover's meta box comes before the one with the custom tags
+			udta := findMP4Box(t, got, "moov", "udta")
+			children, err := readMP4Boxes(bytes.NewReader(got), udta.Start+udta.HeaderSize, udta.End)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantChildren := 1
+			if tt.withUdta {
+				wantChildren = 2
+				if tags := children[1].Payload(got); !bytes.HasSuffix(tags, []byte("custom tags")) {
+					t.Errorf("second meta box = %q, want the custom tags", tags)
+				}
+			}
+			if len(children) != wantChildren {
+				t.Errorf("udta has %d boxes, want %d", len(children), wantChildren)
+			}
+
+			stco := findMP4Box(t, got, "moov", "trak", "mdia", "minf", "stbl", "stco").Payload(got)
+			for i, chunk := range chunks {
+				offset := binary.BigEndian.Uint32(stco[8+4*i:])
+				if int(offset)+len(chunk) > len(got) || !bytes.Equal(got[offset:int(offset)+len(chunk)], chunk) {
+					t.Errorf("chunk %d offset %d doesn't point at %q", i, offset, chunk)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// OverlayPosition is where text or a watermark is drawn on the video
+type OverlayPosition string
+
+const (
+	// OverlayPositionTop and OverlayPositionBottom are large centered text, meme-style
+	OverlayPositionTop    OverlayPosition = "top"
+	OverlayPositionBottom OverlayPosition = "bottom"
+	// OverlayPositionLowerThird is smaller text on a translucent box a third of the way up from the bottom
+	OverlayPositionLowerThird  OverlayPosition = "lower_third"
+	OverlayPositionTopLeft     OverlayPosition = "top_left"
+	OverlayPositionTopRight    OverlayPosition = "top_right"
+	OverlayPositionBottomLeft  OverlayPosition = "bottom_left"
+	OverlayPositionBottomRight OverlayPosition = "bottom_right"
+)
+
+func ParseTextPosition(s string) (OverlayPosition, error) {
+	switch OverlayPosition(s) {
+	case "":
+		return OverlayPositionBottom, nil
+	case OverlayPositionTop, OverlayPositionBottom, OverlayPositionLowerThird:
+		return OverlayPosition(s), nil
+	default:
+		return "", fmt.Errorf("unknown text position %q", s)
+	}
+}
+
+func ParseWatermarkPosition(s string) (OverlayPosition, error) {
+	switch OverlayPosition(s) {
+	case "":
+		return OverlayPositionBottomRight, nil
+	case OverlayPositionTopLeft, OverlayPositionTopRight, OverlayPositionBottomLeft, OverlayPositionBottomRight:
+		return OverlayPosition(s), nil
+	default:
+		return "", fmt.Errorf("unknown watermark position %q", s)
+	}
+}
+
+// Overlay is the text and images drawn over a clip
+type Overlay struct {
+	Text         string
+	TextPosition OverlayPosition
+	// Caption adds a small "Show S01E02 - timestamp" caption in the bottom left corner
+	Caption bool
+	// Font is the path of a font file, fontconfig's default sans-serif font is used if it's empty
+	Font      string
+	Watermark *Watermark
+}
+
+// Watermark is an image drawn in a corner of the clip
+type Watermark struct {
+	Image    string
+	Position OverlayPosition
+	// Opacity is between 0 and 1
+	Opacity float64
+	// Scale is the height of the watermark relative to the video
+	Scale float64
+}
+
+func (o Overlay) IsZero() bool {
+	return o.Text == "" && !o.Caption && o.Watermark == nil
+}
+
+// Graph returns a filtergraph that runs the filters in chain and then draws the overlay.
+// Its input and output are unlabelled so that it can be used with -vf.
+func (o Overlay) Graph(chain string, caption string) string {
+	if chain == "" {
+		chain = "null"
+	}
+
+	graph := chain
+	if o.Watermark != nil {
+		graph = fmt.Sprintf("%s[base];movie=%s,format=rgba,colorchannelmixer=aa=%s[logo];"+
+			"[logo][base]scale2ref=w=oh*mdar:h=ih*%s[logo][base];[base][logo]overlay=%s",
+			chain,
+			escapeFilterValue(o.Watermark.Image),
+			strconv.FormatFloat(o.Watermark.Opacity, 'f', -1, 64),
+			strconv.FormatFloat(o.Watermark.Scale, 'f', -1, 64),
+			o.Watermark.Position.overlayXY(),
+		)
+	}
+
+	if o.Text != "" {
+		graph += "," + o.drawText(o.Text, o.TextPosition)
+	}
+	if o.Caption && caption != "" {
+		graph += "," + o.drawText(caption, "")
+	}
+
+	return graph
+}
+
+// drawText draws the text at the position, or as a caption if the position is empty
+func (o Overlay) drawText(text string, position OverlayPosition) string {
+	options := []string{
+		"text=" + escapeFilterValue(text),
+		// Don't treat % in the text as the start of an expansion
+		"expansion=none",
+		"fontcolor=white",
+	}
+
+	if o.Font != "" {
+		options = append(options, "fontfile="+escapeFilterValue(o.Font))
+	}
+
+	// Font sizes and margins are relative to the video height so that they look the same at any resolution
+	switch position {
+	case OverlayPositionTop:
+		options = append(options, "fontsize=h/12", "borderw=3", "bordercolor=black", "x=(w-text_w)/2", "y=h/20")
+	case OverlayPositionBottom:
+		options = append(options, "fontsize=h/12", "borderw=3", "bordercolor=black", "x=(w-text_w)/2", "y=h-text_h-h/20")
+	case OverlayPositionLowerThird:
+		options = append(options, "fontsize=h/20", "box=1", "boxcolor=black@0.5", "boxborderw=10", "x=w/20", "y=h*2/3")
+	default:
+		options = append(options, "fontsize=h/36", "box=1", "boxcolor=black@0.5", "boxborderw=6", "x=h/40", "y=h-text_h-h/40")
+	}
+
+	return "drawtext=" + strings.Join(options, ":")
+}
+
+// overlayXY returns the overlay filter's position options for a corner, with a margin relative to the video height
+func (p OverlayPosition) overlayXY() string {
+	switch p {
+	case OverlayPositionTopLeft:
+		return "x=main_h/40:y=main_h/40"
+	case OverlayPositionTopRight:
+		return "x=main_w-overlay_w-main_h/40:y=main_h/40"
+	case OverlayPositionBottomLeft:
+		return "x=main_h/40:y=main_h-overlay_h-main_h/40"
+	default:
+		return "x=main_w-overlay_w-main_h/40:y=main_h-overlay_h-main_h/40"
+	}
+}
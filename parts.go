@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/LukeHagar/plexgo/models/operations"
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+const (
+	// concatProtocols are the protocols the concat demuxer is allowed to open. Parts are read over HTTP(S) from Plex.
+	concatProtocols = "file,http,https,tcp,tls,crypto"
+	// concatListHeader starts every concat demuxer list
+	concatListHeader = "ffconcat version 1.0\n"
+)
+
+// MediaPart is a file of a media item. Movies can be split across files, e.g. CD1 and CD2.
+type MediaPart struct {
+	Part operations.GetMetadataPart
+	// Start is where the part starts in the media
+	Start    time.Duration
+	Duration time.Duration
+}
+
+// mediaParts returns the parts of the media with where they start
+func mediaParts(media operations.GetMetadataMedia) []MediaPart {
+	var parts []MediaPart
+	var start time.Duration
+
+	for _, part := range media.Part {
+		if part.Key == nil {
+			continue
+		}
+
+		duration := time.Duration(deref(part.Duration)) * time.Millisecond
+		parts = append(parts, MediaPart{Part: part, Start: start, Duration: duration})
+		start += duration
+	}
+
+	return parts
+}
+
+// PartInput is what ffmpeg reads a range of the media from
+type PartInput struct {
+	URL string
+	// Offset is where URL starts in the media
+	Offset time.Duration
+	// List is set to a concat demuxer list when the range spans more than one part or is read from Plex. The list
+	// includes the token for the parts that are read from Plex, so rather than being written to a file or passed as an
+	// argument it's passed to ffmpeg through a pipe, and URL is the pipe that it's read from.
+	List string
+}
+
+// Pipes are what's passed to ffmpeg through pipes to read the input
+func (p PartInput) Pipes() []string {
+	if p.List == "" {
+		return nil
+	}
+	return []string{p.List}
+}
+
+// partInput finds the parts of the media that the from-to range covers. Ranges in a single part read that part,
+// ranges that span parts read them in sequence with the concat demuxer.
+func (a *Application) partInput(parts []MediaPart, from, to string) (*PartInput, error) {
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("media has no parts")
+	}
+
+	if len(parts) == 1 {
+		input := a.readPart(parts[0])
+		return &input, nil
+	}
+
+	fromTime, err := ParseTimestamp(from)
+	if err != nil {
+		return nil, err
+	}
+	toTime, err := ParseTimestamp(to)
+	if err != nil {
+		return nil, err
+	}
+
+	first, last := -1, -1
+	for i, part := range parts {
+		if part.Duration <= 0 {
+			return nil, fmt.Errorf("duration of part %d is unknown", i+1)
+		}
+		if first < 0 && fromTime < part.Start+part.Duration {
+			first = i
+		}
+		if toTime > part.Start {
+			last = i
+		}
+	}
+
+	if first < 0 || last < first {
+		return nil, fmt.Errorf("clip is outside of the media")
+	}
+
+	if first == last {
+		input := a.readPart(parts[first])
+		input.Offset = parts[first].Start
+		return &input, nil
+	}
+
+	return &PartInput{
+		URL:    ffmpegPipe(0),
+		Offset: parts[first].Start,
+		List:   a.concatList(parts[first : last+1]),
+	}, nil
+}
+
+// readPart returns the input that reads the whole part. Parts that are read from Plex are read through a concat list
+// of just that part, which is how the token is passed to ffmpeg without it being in ffmpeg's arguments.
+func (a *Application) readPart(part MediaPart) PartInput {
+	url, headers := a.partURL(part.Part)
+	if headers == "" {
+		return PartInput{URL: url}
+	}
+
+	return PartInput{URL: ffmpegPipe(0), List: a.concatList([]MediaPart{part})}
+}
+
+// plexInput returns the input that reads a file other than a media part, such as sidecar subtitles, from Plex
+func (a *Application) plexInput(url string) PartInput {
+	b := &strings.Builder{}
+	b.WriteString(concatListHeader)
+	writeConcatFile(b, url, a.plexHeaders(), 0)
+
+	return PartInput{URL: ffmpegPipe(0), List: b.String()}
+}
+
+// partAt returns the part that the timestamp in the media is in, and the timestamp within that part
+func partAt(parts []MediaPart, at time.Duration) (MediaPart, time.Duration, error) {
+	if len(parts) == 0 {
+		return MediaPart{}, 0, fmt.Errorf("media has no parts")
+	}
+
+	if len(parts) == 1 {
+		return parts[0], at, nil
+	}
+
+	for i, part := range parts {
+		if part.Duration <= 0 {
+			return MediaPart{}, 0, fmt.Errorf("duration of part %d is unknown", i+1)
+		}
+		if at < part.Start+part.Duration {
+			return part, at - part.Start, nil
+		}
+	}
+
+	return MediaPart{}, 0, fmt.Errorf("timestamp is outside of the media")
+}
+
+// concatList returns a concat demuxer list of the parts. Their durations are included so that seeking doesn't have to
+// open each part to find its length.
+func (a *Application) concatList(parts []MediaPart) string {
+	b := &strings.Builder{}
+	b.WriteString(concatListHeader)
+
+	for _, part := range parts {
+		url, headers := a.partURL(part.Part)
+		writeConcatFile(b, url, headers, part.Duration)
+	}
+
+	return b.String()
+}
+
+// writeConcatFile adds a file to a concat demuxer list. The headers are sent when the file is read over HTTP, and the
+// duration is left out when it's unknown.
+func writeConcatFile(b *strings.Builder, url, headers string, duration time.Duration) {
+	fmt.Fprintf(b, "file %s\n", quoteConcatValue(url))
+	if headers != "" {
+		fmt.Fprintf(b, "option headers %s\n", quoteConcatValue(headers))
+	}
+	if duration > 0 {
+		fmt.Fprintf(b, "duration %.3f\n", duration.Seconds())
+	}
+}
+
+// quoteConcatValue quotes a value in a concat demuxer list
+func quoteConcatValue(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// InputArgs returns the input options that read the from-to range of the media from URL. Empty timestamps read from
+// the start or to the end.
+func (p PartInput) InputArgs(from, to string) ffmpeg.KwArgs {
+	args := ffmpeg.KwArgs{}
+	if from != "" {
+		args["ss"] = partTimestamp(from, p.Offset)
+	}
+	if to != "" {
+		args["to"] = partTimestamp(to, p.Offset)
+	}
+
+	if p.List != "" {
+		args["f"] = "concat"
+		args["safe"] = 0
+		args["protocol_whitelist"] = concatProtocols
+	}
+
+	return args
+}
+
+// partTimestamp converts a timestamp in the media to one in a part that starts at offset
+func partTimestamp(ts string, offset time.Duration) string {
+	if offset == 0 {
+		return ts
+	}
+
+	d, err := ParseTimestamp(ts)
+	if err != nil {
+		return ts
+	}
+
+	return FormatTimestamp(d - offset)
+}
+
+// MediaVersions are the versions (media) of an item, and the other editions of a movie
+type MediaVersions struct {
+	EditionTitle string
+	Versions     []MediaVersion
+	Editions     []Edition
+}
+
+// MediaVersion is one of the files or sets of files that an item can be clipped from
+type MediaVersion struct {
+	ID         int
+	Title      string
+	Resolution string
+	Width      int
+	Height     int
+	VideoCodec string
+	AudioCodec string
+	Container  string
+	Bitrate    int
+	HDR        HDRFormat
+	Duration   time.Duration
+	Parts      []MediaPart
+}
+
+// Edition is another edition of a movie, such as a director's cut. Plex stores editions as separate items.
+type Edition struct {
+	RatingKey    string
+	EditionTitle string
+}
+
+type plexEditionsResponse struct {
+	MediaContainer struct {
+		Metadata []struct {
+			RatingKey        string `json:"ratingKey"`
+			GUID             string `json:"guid"`
+			EditionTitle     string `json:"editionTitle"`
+			LibrarySectionID int    `json:"librarySectionID"`
+			Media            []struct {
+				ID    int    `json:"id"`
+				Title string `json:"title"`
+			} `json:"Media"`
+		} `json:"Metadata"`
+	} `json:"MediaContainer"`
+}
+
+// MediaVersions lists the versions and editions of the rating key's item
+func (a *Application) MediaVersions(ctx context.Context, ratingKeyStr string) (*MediaVersions, error) {
+	metadata, err := a.metadata(ctx, ratingKeyStr)
+	if err != nil {
+		return nil, err
+	}
+
+	// The Plex API client doesn't include edition and version titles, so they're requested separately
+	var body plexEditionsResponse
+	if err := a.plexGet(ctx, "/library/metadata/"+ratingKeyStr, &body); err != nil {
+		return nil, fmt.Errorf("could not get editions: %w", err)
+	}
+
+	versions := &MediaVersions{}
+	mediaTitles := map[int]string{}
+
+	if len(body.MediaContainer.Metadata) > 0 {
+		item := body.MediaContainer.Metadata[0]
+		versions.EditionTitle = item.EditionTitle
+		for _, m := range item.Media {
+			mediaTitles[m.ID] = m.Title
+		}
+
+		if deref(metadata.Type) == MediaTypeMovie && item.GUID != "" && item.LibrarySectionID != 0 {
+			versions.Editions, err = a.editions(ctx, item.LibrarySectionID, item.GUID, ratingKeyStr)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, media := range metadata.Media {
+		source := NewVideoSource(media)
+		version := MediaVersion{
+			ID:         deref(media.ID),
+			Title:      mediaTitles[deref(media.ID)],
+			Resolution: deref(media.VideoResolution),
+			Width:      source.Width,
+			Height:     source.Height,
+			VideoCodec: deref(media.VideoCodec),
+			AudioCodec: deref(media.AudioCodec),
+			Container:  deref(media.Container),
+			Bitrate:    deref(media.Bitrate),
+			HDR:        source.HDR,
+			Duration:   time.Duration(deref(media.Duration)) * time.Millisecond,
+			Parts:      mediaParts(media),
+		}
+		versions.Versions = append(versions.Versions, version)
+	}
+
+	return versions, nil
+}
+
+// editions finds the other editions of a movie, which share its GUID
+func (a *Application) editions(ctx context.Context, sectionID int, guid, ratingKeyStr string) ([]Edition, error) {
+	var body plexEditionsResponse
+	path := fmt.Sprintf("/library/sections/%d/all?guid=%s", sectionID, url.QueryEscape(guid))
+	if err := a.plexGet(ctx, path, &body); err != nil {
+		return nil, fmt.Errorf("could not get editions: %w", err)
+	}
+
+	var editions []Edition
+	for _, item := range body.MediaContainer.Metadata {
+		if item.RatingKey == ratingKeyStr || item.GUID != guid {
+			continue
+		}
+		editions = append(editions, Edition{RatingKey: item.RatingKey, EditionTitle: item.EditionTitle})
+	}
+
+	return editions, nil
+}
+
+// partName is the file name of the part, without the directories of the server's file system
+func partName(part operations.GetMetadataPart) string {
+	if part.File == nil {
+		return ""
+	}
+	return path.Base(strings.ReplaceAll(deref(part.File), `\`, "/"))
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/LukeHagar/plexgo"
+	"github.com/LukeHagar/plexgo/models/operations"
+)
+
+func testApplication() *Application {
+	a := &Application{}
+	a.config.Plex.Host = "http://plex:32400"
+	a.config.Plex.Token = "secret"
+	return a
+}
+
+// testParts returns parts with the durations that are read from Plex
+func testParts(durations ...time.Duration) []operations.GetMetadataPart {
+	var parts []operations.GetMetadataPart
+	for i, d := range durations {
+		key := "/library/parts/" + strconv.Itoa(i+1) + "/file.mkv"
+		ms := int(d.Milliseconds())
+		parts = append(parts, operations.GetMetadataPart{Key: &key, Duration: &ms})
+	}
+	return parts
+}
+
+func TestMediaParts(t *testing.T) {
+	media := operations.GetMetadataMedia{Part: testParts(10*time.Minute, 20*time.Minute, 15*time.Minute)}
+	// Parts without a key can't be read and are skipped
+	media.Part = append(media.Part[:1], append([]operations.GetMetadataPart{{}}, media.Part[1:]...)...)
+
+	var starts []time.Duration
+	for _, part := range mediaParts(media) {
+		starts = append(starts, part.Start)
+	}
+
+	want := []time.Duration{0, 10 * time.Minute, 30 * time.Minute}
+	if !reflect.DeepEqual(starts, want) {
+		t.Errorf("part starts = %v, want %v", starts, want)
+	}
+}
+
+func TestPartAt(t *testing.T) {
+	parts := mediaParts(operations.GetMetadataMedia{Part: testParts(10*time.Minute, 20*time.Minute, 15*time.Minute)})
+
+	tests := []struct {
+		name     string
+		parts    []MediaPart
+		at       time.Duration
+		wantPart int
+		wantAt   time.Duration
+		wantErr  bool
+	}{
+		{name: "start", parts: parts, at: 0, wantPart: 0, wantAt: 0},
+		{name: "first part", parts: parts, at: 5 * time.Minute, wantPart: 0, wantAt: 5 * time.Minute},
+		{name: "start of second part", parts: parts, at: 10 * time.Minute, wantPart: 1, wantAt: 0},
+		{name: "last part", parts: parts, at: 40 * time.Minute, wantPart: 2, wantAt: 10 * time.Minute},
+		{name: "after the end", parts: parts, at: 45 * time.Minute, wantErr: true},
+		{name: "single part", parts: parts[:1], at: time.Hour, wantPart: 0, wantAt: time.Hour},
+		{name: "no parts", parts: nil, wantErr: true},
+		{name: "unknown duration", parts: []MediaPart{parts[0], {Part: parts[1].Part}}, at: 20 * time.Minute, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			part, at, err := partAt(tt.parts, tt.at)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("partAt(%v) = part %s at %v, want an error", tt.at, deref(part.Part.Key), at)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("partAt(%v) returned an error: %v", tt.at, err)
+			}
+			if part.Part.Key != tt.parts[tt.wantPart].Part.Key || at != tt.wantAt {
+				t.Errorf("partAt(%v) = part %s at %v, want part %s at %v",
+					tt.at, deref(part.Part.Key), at, deref(tt.parts[tt.wantPart].Part.Key), tt.wantAt)
+			}
+		})
+	}
+}
+
+func TestPartTimestamp(t *testing.T) {
+	tests := []struct {
+		ts     string
+		offset time.Duration
+		want   string
+	}{
+		{ts: "00:05:00", offset: 0, want: "00:05:00"},
+		{ts: "00:15:00.500", offset: 10 * time.Minute, want: "00:05:00.500"},
+		{ts: "00:05:00", offset: 10 * time.Minute, want: "00:00:00.000"},
+		{ts: "invalid", offset: 10 * time.Minute, want: "invalid"},
+	}
+
+	for _, tt := range tests {
+		if got := partTimestamp(tt.ts, tt.offset); got != tt.want {
+			t.Errorf("partTimestamp(%q, %v) = %q, want %q", tt.ts, tt.offset, got, tt.want)
+		}
+	}
+}
+
+func TestPartInput(t *testing.T) {
+	a := testApplication()
+	parts := mediaParts(operations.GetMetadataMedia{Part: testParts(10*time.Minute, 20*time.Minute, 15*time.Minute)})
+
+	// Parts that are readable locally are read from the filesystem rather than through a concat list
+	local := filepath.Join(t.TempDir(), "cd1.mkv")
+	if err := os.WriteFile(local, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	localParts := mediaParts(operations.GetMetadataMedia{Part: testParts(10*time.Minute, 20*time.Minute)})
+	localParts[0].Part.File = &local
+
+	tests := []struct {
+		name     string
+		parts    []MediaPart
+		from, to string
+		want     *PartInput
+		wantErr  bool
+	}{
+		{
+			name:  "single part",
+			parts: parts[:1],
+			from:  "00:01:00", to: "00:02:00",
+			want: &PartInput{
+				URL: "/dev/fd/3",
+				List: "ffconcat version 1.0\n" +
+					"file 'http://plex:32400/library/parts/1/file.mkv'\n" +
+					"option headers 'X-Plex-Token: secret'\n" +
+					"duration 600.000\n",
+			},
+		},
+		{
+			name:  "second part",
+			parts: parts,
+			from:  "00:15:00", to: "00:16:00",
+			want: &PartInput{
+				URL:    "/dev/fd/3",
+				Offset: 10 * time.Minute,
+				List: "ffconcat version 1.0\n" +
+					"file 'http://plex:32400/library/parts/2/file.mkv'\n" +
+					"option headers 'X-Plex-Token: secret'\n" +
+					"duration 1200.000\n",
+			},
+		},
+		{
+			name:  "local part",
+			parts: localParts,
+			from:  "00:01:00", to: "00:02:00",
+			want: &PartInput{URL: local},
+		},
+		{
+			name:  "spanning parts",
+			parts: parts,
+			from:  "00:29:00", to: "00:31:00",
+			want: &PartInput{
+				URL:    "/dev/fd/3",
+				Offset: 10 * time.Minute,
+				List: "ffconcat version 1.0\n" +
+					"file 'http://plex:32400/library/parts/2/file.mkv'\n" +
+					"option headers 'X-Plex-Token: secret'\n" +
+					"duration 1200.000\n" +
+					"file 'http://plex:32400/library/parts/3/file.mkv'\n" +
+					"option headers 'X-Plex-Token: secret'\n" +
+					"duration 900.000\n",
+			},
+		},
+		{
+			name:  "spanning local and remote parts",
+			parts: localParts,
+			from:  "00:09:00", to: "00:11:00",
+			want: &PartInput{
+				URL: "/dev/fd/3",
+				List: "ffconcat version 1.0\n" +
+					"file '" + local + "'\n" +
+					"duration 600.000\n" +
+					"file 'http://plex:32400/library/parts/2/file.mkv'\n" +
+					"option headers 'X-Plex-Token: secret'\n" +
+					"duration 1200.000\n",
+			},
+		},
+		{name: "outside of the media", parts: parts, from: "01:00:00", to: "01:01:00", wantErr: true},
+		{name: "unknown duration", parts: []MediaPart{parts[0], {Part: parts[1].Part}}, from: "00:01:00", to: "00:02:00", wantErr: true},
+		{name: "invalid timestamp", parts: parts, from: "invalid", to: "00:02:00", wantErr: true},
+		{name: "no parts", from: "00:01:00", to: "00:02:00", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := a.partInput(tt.parts, tt.from, tt.to)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("partInput(%s, %s) = %+v, want an error", tt.from, tt.to, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("partInput(%s, %s) returned an error: %v", tt.from, tt.to, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("partInput(%s, %s) = %+v, want %+v", tt.from, tt.to, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestTokenNotInArgs checks that the Plex token is only ever passed to ffmpeg through pipes, since anyone on the host
+// can read ffmpeg's arguments
+func TestTokenNotInArgs(t *testing.T) {
+	a := testApplication()
+	parts := mediaParts(operations.GetMetadataMedia{Part: testParts(10*time.Minute, 20*time.Minute)})
+
+	var args [][]string
+	for _, r := range [][2]string{{"00:01:00", "00:02:00"}, {"00:11:00", "00:12:00"}, {"00:09:00", "00:11:00"}} {
+		input, err := a.partInput(parts, r[0], r[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		params := clipParams(CodecLibx264, sdrSource)
+		params.URL, params.Offset, params.List = input.URL, input.Offset, input.List
+		args = append(args, NewPipeline(params).Stream().GetArgs())
+	}
+
+	subtitles, err := a.subtitleSource(operations.GetMetadataPart{Stream: []operations.Stream{{
+		ID:         plexgo.Int(7),
+		StreamType: plexgo.Int(plexStreamTypeSubtitle),
+	}}}, "7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	args = append(args, frameArgs(FrameParams{
+		Input:     a.readPart(parts[0]),
+		At:        time.Minute,
+		Subtitles: subtitles,
+		Path:      "frame.jpg",
+	}))
+
+	for _, command := range args {
+		for _, arg := range command {
+			if strings.Contains(arg, a.config.Plex.Token) {
+				t.Errorf("argument %q contains the token", arg)
+			}
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/LukeHagar/plexgo/models/operations"
+)
+
+// plexTokenPattern matches Plex tokens in the query strings of URLs and in headers
+var plexTokenPattern = regexp.MustCompile(`(X-Plex-Token(?:=|:\s*))[^&\s'"]+`)
+
+// PathMapping translates the path of media on the Plex server to where the same directory is mounted locally
+type PathMapping struct {
+	// Plex is the directory as Plex sees it, e.g. /data/media or D:\Media
+	Plex string `mapstructure:"plex"`
+	// Local is where the directory is mounted on this machine, e.g. /mnt/media
+	Local string `mapstructure:"local"`
+}
+
+func ParsePathMappings(mappings []PathMapping) ([]PathMapping, error) {
+	for i, m := range mappings {
+		if m.Plex == "" || m.Local == "" {
+			return nil, fmt.Errorf("path mapping %d needs both a plex and a local path", i+1)
+		}
+		if !filepath.IsAbs(m.Local) {
+			return nil, fmt.Errorf("local path %q of path mapping %d is not absolute", m.Local, i+1)
+		}
+	}
+
+	return mappings, nil
+}
+
+// apply translates the file's path if it's in the mapping's Plex directory
+func (m PathMapping) apply(file string) (string, bool) {
+	prefix := strings.TrimRight(m.Plex, `/\`)
+	if !strings.HasPrefix(file, prefix) {
+		return "", false
+	}
+
+	// The prefix has to match whole directories, /data/media shouldn't match /data/media2
+	rest := file[len(prefix):]
+	if rest == "" || (rest[0] != '/' && rest[0] != '\\') {
+		return "", false
+	}
+
+	// Windows servers use backslashes as separators
+	if strings.Contains(m.Plex, `\`) {
+		rest = strings.ReplaceAll(rest, `\`, "/")
+	}
+
+	return filepath.Join(m.Local, filepath.FromSlash(rest)), true
+}
+
+// mapPath translates the path of a file on the Plex server to its local path using the longest matching mapping.
+// Paths that don't match any mapping are used as they are, for when CutScene runs on the same machine as Plex or has
+// the media mounted at the same path.
+func (a *Application) mapPath(file string) string {
+	mapped, matched := file, 0
+	for _, m := range a.config.Plex.PathMappings {
+		if path, ok := m.apply(file); ok && len(m.Plex) > matched {
+			mapped, matched = path, len(m.Plex)
+		}
+	}
+	return mapped
+}
+
+// localPath returns the local path of the part's file if it can be read directly from the filesystem
+func (a *Application) localPath(part operations.GetMetadataPart) (string, bool) {
+	if part.File == nil {
+		return "", false
+	}
+
+	path := a.mapPath(*part.File)
+
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return "", false
+	}
+
+	// The file can exist without CutScene having permission to read it
+	f, err := os.Open(path)
+	if err != nil {
+		return "", false
+	}
+	_ = f.Close()
+
+	return path, true
+}
+
+// partURL is the URL that ffmpeg reads the media part from, and the headers to read it with. Files are read directly
+// when they're readable locally, which is faster to seek in than reading them from Plex over HTTP.
+func (a *Application) partURL(part operations.GetMetadataPart) (string, string) {
+	if path, ok := a.localPath(part); ok {
+		return path, ""
+	}
+
+	return a.config.Plex.Host + *part.Key, a.plexHeaders()
+}
+
+// plexHeaders are the headers that ffmpeg sends with requests to Plex. They're only ever written to the concat lists
+// that are piped to ffmpeg, since anyone on the host can read ffmpeg's arguments from the process list. Values in a
+// concat list can't span lines, ffmpeg adds the missing CRLF itself.
+func (a *Application) plexHeaders() string {
+	return "X-Plex-Token: " + a.config.Plex.Token
+}
+
+// redactTokens hides the Plex tokens in URLs and headers so that they don't end up in logs and error messages
+func redactTokens(s string) string {
+	return plexTokenPattern.ReplaceAllString(s, "${1}REDACTED")
+}
@@ -0,0 +1,591 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+// ffmpegStopTimeout is how long ffmpeg has to exit after SIGTERM before it's killed
+const ffmpegStopTimeout = 5 * time.Second
+
+// Container is the format of the encoded output
+type Container string
+
+const (
+	// ContainerMP4 is a regular MP4 file with the index at the start so that it can be played while downloading
+	ContainerMP4 Container = "mp4"
+	// ContainerFragmentedMP4 can be written to a non-seekable sink such as an HTTP response
+	ContainerFragmentedMP4 Container = "fmp4"
+	// ContainerMPEGTS is used for HLS segments. Timestamps are offset by the start of the range so that
+	// consecutive segments play back continuously.
+	ContainerMPEGTS Container = "mpegts"
+)
+
+// Pipeline builds and runs the ffmpeg command for an encode described by FfmpegParams.
+// Clips and previews both go through a Pipeline so that they share the same hardware acceleration, tonemapping,
+// scaling and rate control logic.
+type Pipeline struct {
+	params FfmpegParams
+	// codec is the encoder that's actually used, which may differ from the requested one when keeping 10-bit color
+	codec     Codec
+	keep10Bit bool
+	input     ffmpeg.KwArgs
+	output    ffmpeg.KwArgs
+	filters   []string
+	// downloaded is set once a hardware pipeline has downloaded the frames for software filters, they're uploaded
+	// again before encoding
+	downloaded bool
+}
+
+// NewEncoderPipeline returns a Pipeline that only encodes, for commands such as compilations that have their own inputs
+// and decode and filter them in software. Their filter graphs end with UploadFilter, and DeviceArgs go before their
+// inputs.
+func NewEncoderPipeline(codec Codec, device string, qp int) *Pipeline {
+	p := &Pipeline{
+		params: FfmpegParams{Codec: codec, Device: device, QP: qp},
+		codec:  codec,
+	}
+
+	if p.codec == "" {
+		p.codec = CodecLibx264
+	}
+
+	p.output = ffmpeg.KwArgs{
+		"acodec": "aac",
+		"vcodec": p.codec,
+	}
+	if p.codec.HWAccel() == HWAccelCUDA {
+		// NVENC uploads the frames itself
+		p.output["gpu"] = device
+	}
+
+	p.buildEncoder()
+
+	return p
+}
+
+func NewPipeline(params FfmpegParams) *Pipeline {
+	p := &Pipeline{
+		params: params,
+		codec:  params.Codec,
+	}
+
+	if p.codec == "" {
+		p.codec = CodecLibx264
+	}
+
+	// 10-bit sources are either tonemapped to SDR 8-bit or encoded with a codec that supports 10-bit color. Dolby Vision
+	// profile 5 is always tonemapped since its colors are wrong without the Dolby Vision metadata.
+	p.keep10Bit = params.HDRMode == HDRModeKeep && params.Source.Is10Bit() && !params.Source.DolbyVisionProfile5
+	if p.keep10Bit && !p.codec.Supports10Bit() {
+		p.codec = p.codec.HEVC()
+	}
+
+	p.buildInput()
+	p.buildOutput()
+
+	if params.Audio.AudioOnly() {
+		p.buildAudioOnly()
+	} else {
+		p.buildVideo()
+
+		if !params.Playback.IsZero() {
+			p.buildPlayback()
+		}
+
+		if !params.Overlay.IsZero() {
+			p.buildOverlay()
+		}
+
+		// Fades are applied last so that the overlay fades with the rest of the video
+		if !params.Fade.IsZero() {
+			p.buildFade()
+		}
+
+		if p.downloaded {
+			p.filters = append(p.filters, p.upload())
+		}
+
+		if len(p.filters) > 0 {
+			p.output["vf"] = strings.Join(p.filters, ",")
+		}
+	}
+
+	audioFilters := append(params.Playback.AudioFilters(), params.Audio.Filters()...)
+	if !params.Fade.IsZero() {
+		audioFilters = append(audioFilters, params.Fade.AudioFilters(p.duration())...)
+	}
+	if len(audioFilters) > 0 {
+		p.output["af"] = strings.Join(audioFilters, ",")
+	}
+
+	return p
+}
+
+// Target is the file path that the encode is written to, or "pipe:" when writing to params.Output
+func (p *Pipeline) Target() string {
+	if p.params.Output != nil {
+		return "pipe:"
+	}
+
+	dir := p.params.Dir
+	if dir == "" {
+		dir = "/tmp"
+	}
+
+	return filepath.Join(dir, p.params.Filename)
+}
+
+func (p *Pipeline) Stream() *ffmpeg.Stream {
+	stream := ffmpeg.
+		Input(p.params.URL, p.input).
+		Output(p.Target(), p.output)
+
+	if p.params.Output == nil {
+		stream = stream.OverWriteOutput()
+	}
+
+	return stream
+}
+
+func (p *Pipeline) Run(ctx context.Context) error {
+	if !p.params.Audio.AudioOnly() {
+		if err := p.params.Source.Check(); err != nil {
+			return err
+		}
+	}
+
+	target := ""
+	if p.params.Output == nil {
+		target = p.Target()
+	}
+
+	return runFfmpeg(ctx, p.Stream().GetArgs(), p.params.Output, target, p.params.Input().Pipes()...)
+}
+
+// DeviceArgs are the global options that open the hardware device that UploadFilter uploads the frames to
+func (p *Pipeline) DeviceArgs() []string {
+	switch p.codec.HWAccel() {
+	case HWAccelVAAPI:
+		return []string{"-init_hw_device", "vaapi=va:" + p.params.Device, "-filter_hw_device", "va"}
+	case HWAccelQSV:
+		return []string{"-init_hw_device", "qsv=qs:hw_any,child_device=" + p.params.Device, "-filter_hw_device", "qs"}
+	default:
+		return nil
+	}
+}
+
+// UploadFilter returns the filters that move software frames to the GPU, or an empty string if the encoder reads them
+// from system memory
+func (p *Pipeline) UploadFilter() string {
+	switch p.codec.HWAccel() {
+	case HWAccelVAAPI, HWAccelQSV:
+		return p.upload()
+	default:
+		return ""
+	}
+}
+
+// Output returns a copy of the output options
+func (p *Pipeline) Output() ffmpeg.KwArgs {
+	return ffmpeg.MergeKwArgs([]ffmpeg.KwArgs{p.output})
+}
+
+// ffmpegPipe is the path that ffmpeg reads the i-th of the pipes passed to runFfmpeg from
+func ffmpegPipe(i int) string {
+	// The first three file descriptors are stdin, stdout and stderr
+	return fmt.Sprintf("/dev/fd/%d", 3+i)
+}
+
+// runFfmpeg runs ffmpeg until it finishes or the context is done. When the context is done, ffmpeg is asked to stop
+// with SIGTERM and killed if it hasn't exited after ffmpegStopTimeout.
+// stdout receives ffmpeg's output if it's not nil. If ffmpeg doesn't finish successfully, the partially written
+// outputFile (if any) is removed. The i-th of pipes is written to a pipe that ffmpeg reads from ffmpegPipe(i), for
+// inputs such as concat lists that include the Plex token and so shouldn't be written to disk.
+func runFfmpeg(ctx context.Context, args []string, stdout io.Writer, outputFile string, pipes ...string) error {
+	_, err := runFfmpegStderr(ctx, args, stdout, outputFile, pipes...)
+	return err
+}
+
+// runFfmpegStderr is runFfmpeg, but also returns what ffmpeg wrote to stderr, for filters that print their results
+// in the logs
+func runFfmpegStderr(ctx context.Context, args []string, stdout io.Writer, outputFile string, pipes ...string) (string, error) {
+	// The token is only ever in the piped concat lists, but it's redacted in case a URL that includes it is passed in
+	log.Printf("running command: ffmpeg %s", redactTokens(strings.Join(args, " ")))
+
+	errBuff := &bytes.Buffer{}
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	cmd.Stderr = errBuff
+	cmd.Stdout = os.Stdout
+	if stdout != nil {
+		cmd.Stdout = stdout
+	}
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(syscall.SIGTERM)
+	}
+	cmd.WaitDelay = ffmpegStopTimeout
+
+	for _, content := range pipes {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return "", err
+		}
+		// ffmpeg has its own copy of the read end once it's started
+		defer r.Close()
+
+		cmd.ExtraFiles = append(cmd.ExtraFiles, r)
+		go func(content string) {
+			_, _ = io.WriteString(w, content)
+			_ = w.Close()
+		}(content)
+	}
+
+	err := cmd.Run()
+
+	var exitErr *exec.ExitError
+	if ctx.Err() != nil {
+		err = fmt.Errorf("ffmpeg stopped: %w", context.Cause(ctx))
+	} else if errors.As(err, &exitErr) {
+		// Capture the ffmpeg process stderr if it exits unsuccessfully
+		err = fmt.Errorf("ffmpeg exited with error:\n%s", redactTokens(errBuff.String()))
+	}
+
+	if err != nil && outputFile != "" {
+		_ = os.Remove(outputFile)
+	}
+
+	stderr := errBuff.String()
+	_, _ = io.WriteString(os.Stderr, redactTokens(stderr))
+
+	return stderr, err
+}
+
+func (p *Pipeline) buildInput() {
+	p.input = p.params.Input().InputArgs(p.params.From, p.params.To)
+	p.input["hwaccel"] = "auto"
+	// TODO: Make these two configurable, we don't want them when trying to troubleshoot
+	p.input["hide_banner"] = ""
+	p.input["loglevel"] = "error"
+
+	// The video isn't decoded for audio-only exports
+	if p.params.Audio.AudioOnly() {
+		delete(p.input, "hwaccel")
+		return
+	}
+
+	switch p.codec.HWAccel() {
+	case HWAccelVAAPI:
+		p.input["hwaccel"] = "vaapi"
+		p.input["hwaccel_device"] = p.params.Device
+		p.input["hwaccel_output_format"] = "vaapi"
+	case HWAccelCUDA:
+		p.input["hwaccel"] = "cuda"
+		p.input["hwaccel_device"] = p.params.Device
+		p.input["hwaccel_output_format"] = "cuda"
+		p.input["extra_hw_frames"] = 8
+	case HWAccelQSV:
+		p.input["hwaccel"] = "qsv"
+		p.input["qsv_device"] = p.params.Device
+		p.input["hwaccel_output_format"] = "qsv"
+	default:
+	}
+}
+
+func (p *Pipeline) buildOutput() {
+	p.output = ffmpeg.KwArgs{
+		"acodec": "aac",
+		"vcodec": p.codec,
+	}
+
+	switch p.params.Container {
+	case ContainerFragmentedMP4:
+		p.output["f"] = "mp4"
+		p.output["movflags"] = "frag_keyframe+empty_moov"
+	case ContainerMPEGTS:
+		p.output["f"] = "mpegts"
+		p.output["output_ts_offset"] = p.params.From
+		p.output["muxdelay"] = 0
+	case ContainerMP4:
+		fallthrough
+	default:
+		// TODO: Might be a good idea to make these configurable or add support for presets
+		p.output["map_chapters"] = -1
+		p.output["map_metadata"] = 0
+		// use_metadata_tags allows the custom tags that record where the clip came from
+		p.output["movflags"] = "+use_metadata_tags+faststart"
+		p.output["metadata"] = p.params.Metadata.Args(p.params.From, p.params.To)
+	}
+}
+
+// buildAudioOnly replaces the video and container options with the audio format's
+func (p *Pipeline) buildAudioOnly() {
+	format := p.params.Audio.Format
+
+	delete(p.output, "vcodec")
+	delete(p.output, "movflags")
+	p.output["vn"] = ""
+	p.output["sn"] = ""
+	// The source's tags are left out since they describe the video rather than the clip
+	p.output["map_metadata"] = -1
+	p.output["metadata"] = p.params.Metadata.AudioArgs(p.params.From, p.params.To)
+
+	for k, v := range format.outputArgs() {
+		p.output[k] = v
+	}
+}
+
+func (p *Pipeline) buildVideo() {
+	height := strconv.Itoa(p.params.Height)
+
+	switch p.codec.HWAccel() {
+	case HWAccelVAAPI:
+		p.filters = append(p.filters, "hwupload")
+		if p.keep10Bit {
+			p.filters = append(p.filters, "scale_vaapi=format=p010")
+		} else {
+			p.filters = append(p.filters, tonemapVAAPI(p.params.Source))
+		}
+		if p.params.Framing.IsZero() {
+			p.filters = append(p.filters, "scale_vaapi=-2:"+height)
+		} else {
+			p.buildFraming()
+		}
+	case HWAccelCUDA:
+		if p.keep10Bit {
+			p.filters = append(p.filters, "scale_cuda=format=p010le")
+		} else if p.params.Source.Is10Bit() {
+			p.filters = append(p.filters, tonemapCUDA(p.params.Source))
+		}
+		if !p.params.Framing.IsZero() {
+			p.buildFraming()
+		} else if p.params.Height > 0 {
+			p.filters = append(p.filters, "scale_cuda=-2:"+height)
+		}
+	case HWAccelQSV:
+		if p.keep10Bit {
+			p.filters = append(p.filters, "scale_qsv=format=p010")
+		} else if p.params.Source.Is10Bit() {
+			p.filters = append(p.filters, tonemapQSV(p.params.Source))
+		}
+		if !p.params.Framing.IsZero() {
+			p.buildFraming()
+		} else if p.params.Height > 0 {
+			p.filters = append(p.filters, "scale_qsv=w=-1:h="+height)
+		}
+	default:
+		if p.keep10Bit {
+			if p.params.Source.IsHDR() {
+				p.output["x265-params"] = x265HDRParams(p.params.Source)
+			}
+		} else if p.params.Source.Is10Bit() {
+			p.filters = append(p.filters, tonemapSoftware(p.params.Source))
+		}
+		if p.params.Framing.IsZero() {
+			p.filters = append(p.filters, "scale=-2:"+height)
+		} else {
+			p.buildFraming()
+		}
+	}
+
+	p.buildEncoder()
+}
+
+// buildEncoder sets the encoder's output options
+func (p *Pipeline) buildEncoder() {
+	if p.codec.IsHEVC() {
+		p.output["tag:v"] = "hvc1" // Required for playback on Apple devices
+		if p.keep10Bit {
+			p.output["profile:v"] = "main10"
+		}
+	}
+
+	if p.codec.HWAccel() == HWAccelNone {
+		p.output["pix_fmt"] = "yuv420p"
+		if p.keep10Bit {
+			p.output["pix_fmt"] = "yuv420p10le"
+		}
+	}
+
+	setRateControl(p.output, p.codec, p.params.QP)
+}
+
+// buildFraming crops, reframes and scales the video. The framing filters only run in software, so hardware pipelines
+// download the frames from the GPU first.
+func (p *Pipeline) buildFraming() {
+	p.download()
+	p.filters = append(p.filters, p.params.Framing.Filters(p.params.Source, p.params.Height)...)
+}
+
+// buildPlayback changes the speed, frame rate and direction of the video after scaling, so that reversing buffers
+// smaller frames. Changing the speed and frame rate works on hardware frames, but reversing and motion interpolation
+// need the frames in system memory.
+func (p *Pipeline) buildPlayback() {
+	playback := p.params.Playback
+	if playback.softwareOnly() {
+		p.download()
+	}
+
+	p.filters = append(p.filters, playback.VideoFilters()...)
+}
+
+// buildFade fades the video in and out. The fade filter only runs in software, so hardware pipelines download the
+// frames from the GPU.
+func (p *Pipeline) buildFade() {
+	p.download()
+	p.filters = append(p.filters, p.params.Fade.VideoFilters(p.duration())...)
+}
+
+// duration is how long the encoded clip plays for, once its speed has been changed
+func (p *Pipeline) duration() time.Duration {
+	from, _ := ParseTimestamp(p.params.From)
+	to, _ := ParseTimestamp(p.params.To)
+
+	return p.params.Playback.Duration(to - from)
+}
+
+// buildOverlay draws the overlay after scaling so that it's sized relative to the output.
+// Text and images are drawn in software, so hardware pipelines download the frames from the GPU.
+func (p *Pipeline) buildOverlay() {
+	p.download()
+	p.filters = []string{p.params.Overlay.Graph(strings.Join(p.filters, ","), p.params.Metadata.Caption(p.params.From))}
+}
+
+// hwFormat is the software pixel format that hardware frames are downloaded to and uploaded from
+func (p *Pipeline) hwFormat() string {
+	if p.keep10Bit {
+		return "p010le"
+	}
+	return "nv12"
+}
+
+// download adds the filters that download hardware frames to system memory, if they haven't been already
+func (p *Pipeline) download() {
+	if p.downloaded || p.codec.HWAccel() == HWAccelNone {
+		return
+	}
+
+	p.filters = append(p.filters, "hwdownload", "format="+p.hwFormat())
+	p.downloaded = true
+}
+
+// upload returns the filters that upload downloaded frames to the GPU again in the same format
+func (p *Pipeline) upload() string {
+	if p.codec.HWAccel() == HWAccelQSV {
+		return "format=" + p.hwFormat() + ",hwupload=extra_hw_frames=64"
+	}
+	return "format=" + p.hwFormat() + ",hwupload"
+}
+
+// setRateControl sets the encoder's quality options on the output. A qp of 0 uses the encoder's default quality.
+func setRateControl(output ffmpeg.KwArgs, codec Codec, qp int) {
+	output["qp"] = codec.QP(qp)
+
+	switch codec.HWAccel() {
+	case HWAccelVAAPI:
+		output["compression_level"] = "0" // https://trac.ffmpeg.org/wiki/Hardware/VAAPI#AMDMesa
+	case HWAccelCUDA:
+		if qp == 0 {
+			output["rc"] = "constqp"
+			output["qp"] = codec.QP(24)
+			output["b:v"] = "0K"
+		}
+	case HWAccelQSV:
+		// QSV doesn't support constant QP without extra options, use intelligent constant quality instead
+		delete(output, "qp")
+		output["global_quality"] = 25
+		if qp > 0 {
+			output["global_quality"] = qp
+		}
+	default:
+		output["crf"] = 23
+		output["b:v"] = 0
+		if codec == CodecLibx264 {
+			// TODO: I'm not sure if this does anything useful
+			output["tune"] = "film"
+		}
+	}
+}
+
+// Args returns the -metadata arguments for the output file, sorted so that the command line is deterministic.
+// Along with the standard tags, the clip's range in the source, the studio and the IDs of the media are written as
+// custom tags so that the clip can be traced back to its source.
+func (m FfmpegParamsMetadata) Args(from, to string) []string {
+	outputMetadata := map[string]string{
+		"title":        m.Title,
+		"comment":      fmt.Sprintf("Clipped from %s, %s - %s", m.Name(), from, to),
+		"source_range": from + "-" + to,
+	}
+
+	if m.Show != "" {
+		outputMetadata["show"] = m.Show
+	}
+	if m.Artist != "" {
+		outputMetadata["artist"] = m.Artist
+	}
+	if m.SeasonNumber != 0 {
+		outputMetadata["season_number"] = strconv.Itoa(m.SeasonNumber)
+	}
+	if m.EpisodeID != 0 {
+		outputMetadata["episode_id"] = strconv.Itoa(m.EpisodeID)
+		outputMetadata["episode_sort"] = strconv.Itoa(m.EpisodeID)
+	}
+	if m.Year != 0 {
+		outputMetadata["year"] = strconv.Itoa(m.Year)
+		outputMetadata["date"] = strconv.Itoa(m.Year)
+	}
+	if m.ReleaseDate != "" {
+		outputMetadata["date"] = m.ReleaseDate
+	}
+	if m.Summary != "" {
+		outputMetadata["description"] = m.Summary
+		outputMetadata["synopsis"] = m.Summary
+	}
+	if len(m.Genres) > 0 {
+		outputMetadata["genre"] = strings.Join(m.Genres, ", ")
+	}
+	if m.Studio != "" {
+		outputMetadata["studio"] = m.Studio
+	}
+	if m.Network != "" {
+		outputMetadata["network"] = m.Network
+	}
+	if m.RatingKey != "" {
+		outputMetadata["plex_rating_key"] = m.RatingKey
+	}
+	// e.g. imdb_id=tt0000000
+	for source, id := range m.GUIDs {
+		outputMetadata[source+"_id"] = id
+	}
+
+	var metadataArr []string
+	for k, v := range outputMetadata {
+		metadataArr = append(metadataArr, fmt.Sprintf("%s=%s", k, v))
+	}
+	sort.Strings(metadataArr)
+
+	return metadataArr
+}
+
+func x265HDRParams(source VideoSource) string {
+	transfer := "smpte2084"
+	if source.HDR == HDRFormatHLG {
+		transfer = "arib-std-b67"
+	}
+
+	return "hdr-opt=1:repeat-headers=1:colorprim=bt2020:colormatrix=bt2020nc:transfer=" + transfer
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// withFfmpegFilters makes the filters the only ones that the local ffmpeg build appears to include, so that the
+// pipelines don't depend on the ffmpeg that the tests happen to run with
+func withFfmpegFilters(t *testing.T, names ...string) {
+	t.Helper()
+
+	ffmpegListingsMu.Lock()
+	previous, ok := ffmpegListings["-filters"]
+	ffmpegListings["-filters"] = names
+	ffmpegListingsMu.Unlock()
+
+	t.Cleanup(func() {
+		ffmpegListingsMu.Lock()
+		defer ffmpegListingsMu.Unlock()
+		if ok {
+			ffmpegListings["-filters"] = previous
+		} else {
+			delete(ffmpegListings, "-filters")
+		}
+	})
+}
+
+// assertGolden compares the arguments, one per line, to the golden file in testdata/name.golden
+func assertGolden(t *testing.T, name string, args []string) {
+	t.Helper()
+
+	path := filepath.Join("testdata", name+".golden")
+	got := strings.Join(args, "\n") + "\n"
+
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(got), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("could not read golden file, run the tests with -update to create it: %v", err)
+	}
+	if got != string(want) {
+		t.Errorf("arguments don't match %s, run the tests with -update if the change is intended\ngot:\n%s\nwant:\n%s", path, got, want)
+	}
+}
+
+var (
+	sdrSource   = VideoSource{BitDepth: 8, Width: 1920, Height: 1080}
+	hdr10Source = VideoSource{HDR: HDRFormatHDR10, BitDepth: 10, Width: 3840, Height: 2160}
+	tenBitSDR   = VideoSource{BitDepth: 10, Width: 1920, Height: 1080}
+	dv5Source   = VideoSource{HDR: HDRFormatDolbyVision, BitDepth: 10, Width: 3840, Height: 2160, DolbyVisionProfile5: true}
+)
+
+// clipParams are the params of a clip of an episode
+func clipParams(codec Codec, source VideoSource) FfmpegParams {
+	return FfmpegParams{
+		URL:      "/media/show/episode.mkv",
+		From:     "00:05:00.000",
+		To:       "00:05:10.500",
+		Filename: "clip.mp4",
+		Height:   720,
+		Codec:    codec,
+		Device:   "/dev/dri/renderD128",
+		Source:   source,
+		HDRMode:  HDRModeTonemap,
+		Metadata: FfmpegParamsMetadata{
+			Title:        "Pilot",
+			Year:         2008,
+			Show:         "Breaking Bad",
+			SeasonNumber: 1,
+			EpisodeID:    1,
+			Genres:       []string{"Drama"},
+			Network:      "AMC",
+			ReleaseDate:  "2008-01-20",
+			RatingKey:    "1234",
+			Type:         MediaTypeEpisode,
+			GUIDs:        map[string]string{"imdb": "tt0959621", "tvdb": "349232"},
+		},
+	}
+}
+
+func TestPipelineArgs(t *testing.T) {
+	withParams := func(params FfmpegParams, f func(*FfmpegParams)) FfmpegParams {
+		f(&params)
+		return params
+	}
+
+	tests := []struct {
+		name    string
+		params  FfmpegParams
+		filters []string
+	}{
+		// Encoders
+		{name: "libx264", params: clipParams(CodecLibx264, sdrSource)},
+		{name: "h264_vaapi", params: clipParams(CodecH264VAAPI, sdrSource)},
+		{name: "h264_nvenc", params: clipParams(CodecH264NVENC, sdrSource)},
+		{name: "h264_qsv", params: clipParams(CodecH264QSV, sdrSource)},
+		{name: "libx265", params: clipParams(CodecLibx265, sdrSource)},
+		{name: "hevc_vaapi", params: clipParams(CodecHEVCVAAPI, sdrSource)},
+		{name: "hevc_nvenc", params: clipParams(CodecHEVCNVENC, sdrSource)},
+		{name: "av1_vaapi", params: clipParams(CodecAV1VAAPI, sdrSource)},
+		{name: "av1_nvenc", params: clipParams(CodecAV1NVENC, sdrSource)},
+		{name: "libx264_qp", params: withParams(clipParams(CodecLibx264, sdrSource), func(p *FfmpegParams) {
+			p.QP = 18
+		})},
+
+		// Containers
+		{name: "preview_fmp4", params: withParams(previewParams(clipParams(CodecH264VAAPI, sdrSource)), func(p *FfmpegParams) {
+			p.Container = ContainerFragmentedMP4
+			p.Output = io.Discard
+		})},
+		{name: "segment_mpegts", params: withParams(previewParams(clipParams(CodecLibx264, sdrSource)), func(p *FfmpegParams) {
+			p.Container = ContainerMPEGTS
+			p.Dir = "/tmp/hls"
+			p.Filename = "segment-3.ts"
+		})},
+
+		// Tonemapping
+		{name: "tonemap_libx264_hdr10", params: clipParams(CodecLibx264, hdr10Source)},
+		{name: "tonemap_libx264_10bit_sdr", params: clipParams(CodecLibx264, tenBitSDR)},
+		{name: "tonemap_vaapi_hdr10", params: clipParams(CodecH264VAAPI, hdr10Source), filters: []string{"tonemap_vaapi"}},
+		{name: "tonemap_vaapi_hdr10_software", params: clipParams(CodecH264VAAPI, hdr10Source)},
+		{name: "tonemap_vaapi_10bit_sdr", params: clipParams(CodecH264VAAPI, tenBitSDR)},
+		{name: "tonemap_cuda_hdr10", params: clipParams(CodecH264NVENC, hdr10Source), filters: []string{"tonemap_cuda"}},
+		{name: "tonemap_cuda_hdr10_software", params: clipParams(CodecH264NVENC, hdr10Source)},
+		{name: "tonemap_qsv_hdr10", params: clipParams(CodecH264QSV, hdr10Source)},
+		{name: "tonemap_libx264_dolby_vision_5", params: clipParams(CodecLibx264, dv5Source), filters: []string{"libplacebo"}},
+		{name: "tonemap_vaapi_dolby_vision_5", params: clipParams(CodecH264VAAPI, dv5Source), filters: []string{"tonemap_vaapi", "libplacebo"}},
+
+		// Keeping HDR
+		{name: "keep_libx264_hdr10", params: withParams(clipParams(CodecLibx264, hdr10Source), func(p *FfmpegParams) {
+			p.HDRMode = HDRModeKeep
+		})},
+		{name: "keep_h264_vaapi_hdr10", params: withParams(clipParams(CodecH264VAAPI, hdr10Source), func(p *FfmpegParams) {
+			p.HDRMode = HDRModeKeep
+		})},
+		{name: "keep_av1_nvenc_hdr10", params: withParams(clipParams(CodecAV1NVENC, hdr10Source), func(p *FfmpegParams) {
+			p.HDRMode = HDRModeKeep
+		})},
+		{name: "keep_libx264_sdr", params: withParams(clipParams(CodecLibx264, sdrSource), func(p *FfmpegParams) {
+			p.HDRMode = HDRModeKeep
+		})},
+		{name: "keep_libx264_dolby_vision_5", params: withParams(clipParams(CodecLibx264, dv5Source), func(p *FfmpegParams) {
+			p.HDRMode = HDRModeKeep
+		}), filters: []string{"libplacebo"}},
+
+		// Parts
+		{name: "part_offset_http", params: withParams(clipParams(CodecLibx264, sdrSource), func(p *FfmpegParams) {
+			p.URL = ffmpegPipe(0)
+			p.Offset = 4 * time.Minute
+			p.List = "ffconcat version 1.0\nfile 'http://plex:32400/library/parts/2/file.mkv'\n"
+		})},
+		{name: "part_concat", params: withParams(clipParams(CodecLibx264, sdrSource), func(p *FfmpegParams) {
+			p.URL = ffmpegPipe(0)
+			p.Offset = 4 * time.Minute
+			p.List = "ffconcat version 1.0\n"
+		})},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withFfmpegFilters(t, tt.filters...)
+			assertGolden(t, filepath.Join("pipeline", tt.name), NewPipeline(tt.params).Stream().GetArgs())
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	playbackMinSpeed = 0.25
+	playbackMaxSpeed = 4
+	playbackMaxFPS   = 120
+	// interpolateDefaultFPS is the frame rate that interpolated clips are output at if one isn't set
+	interpolateDefaultFPS = 60
+	// reverseMaxDuration limits the length of reversed clips since ffmpeg's reverse filters buffer the whole clip in memory
+	reverseMaxDuration = time.Minute
+)
+
+// Playback changes the speed and direction of a clip
+type Playback struct {
+	// Speed is a multiplier of the playback speed, 0 and 1 are normal speed
+	Speed   float64
+	Reverse bool
+	// Boomerang plays the clip forwards and then backwards
+	Boomerang bool
+	// FPS is the frame rate of the clip, 0 keeps the source's frame rate
+	FPS int
+	// Interpolate creates frames with motion interpolation rather than duplicating them, for smooth slow motion
+	Interpolate bool
+}
+
+func ParseSpeed(s string) (float64, error) {
+	if s == "" {
+		return 1, nil
+	}
+
+	speed, err := strconv.ParseFloat(s, 64)
+	if err != nil || speed < playbackMinSpeed || speed > playbackMaxSpeed {
+		return 0, fmt.Errorf("speed must be a number between %v and %v", playbackMinSpeed, playbackMaxSpeed)
+	}
+
+	return speed, nil
+}
+
+func ParseFPS(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	fps, err := strconv.Atoi(s)
+	if err != nil || fps < 1 || fps > playbackMaxFPS {
+		return 0, fmt.Errorf("fps must be an integer between 1 and %d", playbackMaxFPS)
+	}
+
+	return fps, nil
+}
+
+func (p Playback) IsZero() bool {
+	return !p.changesSpeed() && !p.Reverse && !p.Boomerang && p.FPS == 0 && !p.Interpolate
+}
+
+// softwareOnly reports whether the filters need the frames in system memory
+func (p Playback) softwareOnly() bool {
+	return p.Reverse || p.Boomerang || p.Interpolate
+}
+
+func (p Playback) changesSpeed() bool {
+	return p.Speed != 0 && p.Speed != 1
+}
+
+// Duration returns how long a clip of the source duration plays for
+func (p Playback) Duration(source time.Duration) time.Duration {
+	if p.changesSpeed() {
+		source = time.Duration(float64(source) / p.Speed)
+	}
+	if p.Boomerang {
+		source *= 2
+	}
+
+	return source
+}
+
+// Validate checks that the from-to range can be played back
+func (p Playback) Validate(from, to string) error {
+	if !p.Reverse && !p.Boomerang {
+		return nil
+	}
+
+	fromTime, err := ParseTimestamp(from)
+	if err != nil {
+		return err
+	}
+	toTime, err := ParseTimestamp(to)
+	if err != nil {
+		return err
+	}
+
+	if toTime-fromTime > reverseMaxDuration {
+		return fmt.Errorf("reversed clips can't be longer than %s", reverseMaxDuration)
+	}
+
+	return nil
+}
+
+// VideoFilters returns the software filters that change the speed and direction of the video.
+// Its input and output are unlabelled so that it can be chained with the other filters.
+func (p Playback) VideoFilters() []string {
+	var filters []string
+
+	if p.changesSpeed() {
+		filters = append(filters, "setpts=PTS/"+strconv.FormatFloat(p.Speed, 'f', -1, 64))
+	}
+
+	// The frame rate is changed after the speed so that interpolation fills in the frames that slowing down spreads out,
+	// and before reversing so that fewer frames are buffered when the frame rate is reduced
+	if p.Interpolate {
+		fps := p.FPS
+		if fps == 0 {
+			fps = interpolateDefaultFPS
+		}
+		filters = append(filters, fmt.Sprintf("minterpolate=fps=%d:mi_mode=mci:mc_mode=aobmc:vsbmc=1", fps))
+	} else if p.FPS > 0 {
+		filters = append(filters, "fps="+strconv.Itoa(p.FPS))
+	}
+
+	if p.Reverse {
+		filters = append(filters, "reverse")
+	}
+	if p.Boomerang {
+		filters = append(filters, "split[fwd][rev];[rev]reverse[rev];[fwd][rev]concat=n=2:v=1:a=0")
+	}
+
+	return filters
+}
+
+// AudioFilters returns the filters that change the speed and direction of the audio to match the video
+func (p Playback) AudioFilters() []string {
+	var filters []string
+
+	if p.changesSpeed() {
+		// atempo is limited to between 0.5x and 2x, so larger changes are chained
+		speed := p.Speed
+		for speed > 2 {
+			filters = append(filters, "atempo=2")
+			speed /= 2
+		}
+		for speed < 0.5 {
+			filters = append(filters, "atempo=0.5")
+			speed /= 0.5
+		}
+		filters = append(filters, "atempo="+strconv.FormatFloat(speed, 'f', -1, 64))
+	}
+	if p.Reverse {
+		filters = append(filters, "areverse")
+	}
+	if p.Boomerang {
+		filters = append(filters, "asplit[fwd][rev];[rev]areverse[rev];[fwd][rev]concat=n=2:v=0:a=1")
+	}
+
+	return filters
+}
+
+// String describes the playback for file names, e.g. "2x reversed"
+func (p Playback) String() string {
+	var parts []string
+
+	if p.changesSpeed() {
+		parts = append(parts, strconv.FormatFloat(p.Speed, 'f', -1, 64)+"x")
+	}
+	if p.Reverse {
+		parts = append(parts, "reversed")
+	}
+	if p.Boomerang {
+		parts = append(parts, "boomerang")
+	}
+	if p.FPS > 0 {
+		parts = append(parts, strconv.Itoa(p.FPS)+"fps")
+	}
+	if p.Interpolate {
+		parts = append(parts, "interpolated")
+	}
+
+	return strings.Join(parts, " ")
+}
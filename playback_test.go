@@ -0,0 +1,103 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPlaybackAudioFilters(t *testing.T) {
+	tests := []struct {
+		name     string
+		playback Playback
+		want     []string
+	}{
+		{name: "normal speed", playback: Playback{Speed: 1}},
+		{name: "unset speed", playback: Playback{}},
+		{name: "double speed", playback: Playback{Speed: 2}, want: []string{"atempo=2"}},
+		{name: "half speed", playback: Playback{Speed: 0.5}, want: []string{"atempo=0.5"}},
+		{name: "1.5x", playback: Playback{Speed: 1.5}, want: []string{"atempo=1.5"}},
+		{name: "3x", playback: Playback{Speed: 3}, want: []string{"atempo=2", "atempo=1.5"}},
+		{name: "4x", playback: Playback{Speed: 4}, want: []string{"atempo=2", "atempo=2"}},
+		{name: "0.3x", playback: Playback{Speed: 0.3}, want: []string{"atempo=0.5", "atempo=0.6"}},
+		{name: "0.25x", playback: Playback{Speed: 0.25}, want: []string{"atempo=0.5", "atempo=0.5"}},
+		{name: "reversed", playback: Playback{Reverse: true}, want: []string{"areverse"}},
+		{
+			name:     "fast and reversed",
+			playback: Playback{Speed: 3, Reverse: true},
+			want:     []string{"atempo=2", "atempo=1.5", "areverse"},
+		},
+		{
+			name:     "boomerang",
+			playback: Playback{Boomerang: true},
+			want:     []string{"asplit[fwd][rev];[rev]areverse[rev];[fwd][rev]concat=n=2:v=0:a=1"},
+		},
+		{name: "frame rate only", playback: Playback{FPS: 60, Interpolate: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.playback.AudioFilters(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("AudioFilters() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlaybackVideoFilters(t *testing.T) {
+	tests := []struct {
+		name     string
+		playback Playback
+		want     []string
+	}{
+		{name: "normal speed", playback: Playback{Speed: 1}},
+		{name: "half speed", playback: Playback{Speed: 0.5}, want: []string{"setpts=PTS/0.5"}},
+		{name: "frame rate", playback: Playback{FPS: 30}, want: []string{"fps=30"}},
+		{
+			name:     "interpolated",
+			playback: Playback{Speed: 0.25, Interpolate: true},
+			want:     []string{"setpts=PTS/0.25", "minterpolate=fps=60:mi_mode=mci:mc_mode=aobmc:vsbmc=1"},
+		},
+		{
+			name:     "interpolated frame rate",
+			playback: Playback{FPS: 120, Interpolate: true},
+			want:     []string{"minterpolate=fps=120:mi_mode=mci:mc_mode=aobmc:vsbmc=1"},
+		},
+		{
+			name:     "reversed boomerang",
+			playback: Playback{Speed: 2, Reverse: true, Boomerang: true},
+			want: []string{
+				"setpts=PTS/2",
+				"reverse",
+				"split[fwd][rev];[rev]reverse[rev];[fwd][rev]concat=n=2:v=1:a=0",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.playback.VideoFilters(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("VideoFilters() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlaybackDuration(t *testing.T) {
+	tests := []struct {
+		playback Playback
+		want     time.Duration
+	}{
+		{playback: Playback{}, want: 10 * time.Second},
+		{playback: Playback{Speed: 2}, want: 5 * time.Second},
+		{playback: Playback{Speed: 0.25}, want: 40 * time.Second},
+		{playback: Playback{Boomerang: true}, want: 20 * time.Second},
+		{playback: Playback{Speed: 2, Boomerang: true}, want: 10 * time.Second},
+	}
+
+	for _, tt := range tests {
+		if got := tt.playback.Duration(10 * time.Second); got != tt.want {
+			t.Errorf("%+v.Duration(10s) = %v, want %v", tt.playback, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/LukeHagar/plexgo/models/operations"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	quotesDefaultLimit = 20
+	quotesMaxLimit     = 100
+)
+
+// quotesSchemaVersion is the version of the quote index's tables, stored in the database's user_version
+const quotesSchemaVersion = 1
+
+var (
+	ErrQuoteNotFound = errors.New("quote not found")
+	// ErrNoSubtitles is returned when indexing media that has no text subtitles
+	ErrNoSubtitles = errors.New("media has no text subtitles")
+
+	srtTimingRegexp = regexp.MustCompile(`(\d+):(\d+):(\d+)[,.](\d+)\s*-->\s*(\d+):(\d+):(\d+)[,.](\d+)`)
+	// subtitleTagRegexp matches HTML style formatting (<i>) and ASS override tags ({\an8}) left in converted subtitles
+	subtitleTagRegexp = regexp.MustCompile(`<[^>]*>|\{\\[^}]*\}`)
+)
+
+// Cue is a line of subtitles and when it's shown
+type Cue struct {
+	Start time.Duration
+	End   time.Duration
+	Text  string
+}
+
+// Quote is a cue found by a quote search
+type Quote struct {
+	ID        int64
+	RatingKey string
+	MediaID   int
+	// Title is the name of the media the quote is from, e.g. "Show S01E02 Episode"
+	Title string
+	Cue
+}
+
+// QuoteIndex is a full text index of the subtitles of media items.
+// It uses FTS4 rather than FTS5 since FTS5 isn't included in the SQLite driver without a build tag.
+// Quote IDs are handed out in search results and clip URLs, so they're kept stable across reindexing: each cue's ID is
+// allocated in quote_ids for its rating key, media ID and start time, and used as the docid of its row in quotes.
+type QuoteIndex struct {
+	db *sql.DB
+}
+
+func NewQuoteIndex(path string) (*QuoteIndex, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open quote index: %w", err)
+	}
+
+	// SQLite only allows one writer at a time
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(`
+		CREATE VIRTUAL TABLE IF NOT EXISTS quotes USING fts4(
+			text, rating_key, media_id, title, start_ms, end_ms,
+			notindexed=rating_key, notindexed=media_id, notindexed=title, notindexed=start_ms, notindexed=end_ms
+		);
+		CREATE TABLE IF NOT EXISTS quote_ids (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			rating_key TEXT NOT NULL,
+			media_id INTEGER NOT NULL,
+			start_ms INTEGER NOT NULL,
+			UNIQUE (rating_key, media_id, start_ms)
+		);
+		CREATE TABLE IF NOT EXISTS quote_items (
+			rating_key TEXT PRIMARY KEY,
+			indexed_at INTEGER NOT NULL
+		);
+	`)
+	if err == nil {
+		err = migrateQuotes(db)
+	}
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("could not create quote index: %w", err)
+	}
+
+	return &QuoteIndex{db: db}, nil
+}
+
+// migrateQuotes clears indexes written before quote IDs were stable, whose docids would collide with the allocated
+// IDs. The items are indexed again the next time the library is indexed.
+func migrateQuotes(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return err
+	}
+	if version >= quotesSchemaVersion {
+		return nil
+	}
+
+	_, err := db.Exec(fmt.Sprintf(`
+		DELETE FROM quotes;
+		DELETE FROM quote_items;
+		PRAGMA user_version = %d;
+	`, quotesSchemaVersion))
+	return err
+}
+
+func (q *QuoteIndex) Close() error {
+	return q.db.Close()
+}
+
+// Indexed reports whether the rating key's subtitles have been indexed
+func (q *QuoteIndex) Indexed(ratingKey string) (bool, error) {
+	var n int
+	err := q.db.QueryRow(`SELECT COUNT(*) FROM quote_items WHERE rating_key = ?`, ratingKey).Scan(&n)
+	return n > 0, err
+}
+
+// Replace replaces the indexed cues of the rating key. Cues keep the IDs they had the last time the media was indexed,
+// cues that start at the same time are combined since they share an ID. The rating key is recorded as indexed even
+// when there are no cues, so that media without subtitles isn't indexed again.
+func (q *QuoteIndex) Replace(ratingKey string, mediaID int, title string, cues []Cue) error {
+	tx, err := q.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if _, err := tx.Exec(`DELETE FROM quotes WHERE rating_key = ?`, ratingKey); err != nil {
+		return err
+	}
+
+	allocate, err := tx.Prepare(`
+		INSERT INTO quote_ids (rating_key, media_id, start_ms) VALUES (?, ?, ?)
+		ON CONFLICT DO UPDATE SET start_ms = excluded.start_ms
+		RETURNING id
+	`)
+	if err != nil {
+		return err
+	}
+
+	defer allocate.Close()
+
+	insert, err := tx.Prepare(`INSERT INTO quotes (docid, text, rating_key, media_id, title, start_ms, end_ms) VALUES (?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+
+	defer insert.Close()
+
+	for _, cue := range mergeCues(cues) {
+		startMs := cue.Start.Milliseconds()
+
+		var id int64
+		if err := allocate.QueryRow(ratingKey, mediaID, startMs).Scan(&id); err != nil {
+			return err
+		}
+
+		if _, err := insert.Exec(id, cue.Text, ratingKey, mediaID, title, startMs, cue.End.Milliseconds()); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`INSERT OR REPLACE INTO quote_items (rating_key, indexed_at) VALUES (?, ?)`, ratingKey, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// mergeCues combines cues that start at the same millisecond, such as lines from two speakers, in the order they're in
+func mergeCues(cues []Cue) []Cue {
+	var merged []Cue
+	index := map[int64]int{}
+
+	for _, cue := range cues {
+		i, ok := index[cue.Start.Milliseconds()]
+		if !ok {
+			index[cue.Start.Milliseconds()] = len(merged)
+			merged = append(merged, cue)
+			continue
+		}
+
+		merged[i].Text += " " + cue.Text
+		merged[i].End = max(merged[i].End, cue.End)
+	}
+
+	return merged
+}
+
+// Search finds the cues that contain the words of the query in order
+func (q *QuoteIndex) Search(query string, limit int) ([]Quote, error) {
+	// Searching for the query as a phrase means the user doesn't need to know the FTS query syntax
+	phrase := `"` + strings.ReplaceAll(query, `"`, `""`) + `"`
+
+	rows, err := q.db.Query(`
+		SELECT rowid, rating_key, media_id, title, start_ms, end_ms, text
+		FROM quotes WHERE quotes MATCH ?
+		ORDER BY title, start_ms
+		LIMIT ?
+	`, phrase, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var quotes []Quote
+	for rows.Next() {
+		quote, err := scanQuote(rows)
+		if err != nil {
+			return nil, err
+		}
+		quotes = append(quotes, *quote)
+	}
+
+	return quotes, rows.Err()
+}
+
+// Quote looks up a quote by the ID returned from Search
+func (q *QuoteIndex) Quote(id int64) (*Quote, error) {
+	row := q.db.QueryRow(`SELECT rowid, rating_key, media_id, title, start_ms, end_ms, text FROM quotes WHERE rowid = ?`, id)
+
+	quote, err := scanQuote(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrQuoteNotFound
+	}
+
+	return quote, err
+}
+
+func scanQuote(row interface{ Scan(...any) error }) (*Quote, error) {
+	var quote Quote
+	var startMs, endMs int64
+
+	err := row.Scan(&quote.ID, &quote.RatingKey, &quote.MediaID, &quote.Title, &startMs, &endMs, &quote.Text)
+	if err != nil {
+		return nil, err
+	}
+
+	quote.Start = time.Duration(startMs) * time.Millisecond
+	quote.End = time.Duration(endMs) * time.Millisecond
+
+	return &quote, nil
+}
+
+// ParseSRT reads the cues of an SRT file
+func ParseSRT(r io.Reader) ([]Cue, error) {
+	var cues []Cue
+	var block []string
+
+	// Each block is a sequence number, the timing line and then the text
+	flush := func() {
+		for i, line := range block {
+			match := srtTimingRegexp.FindStringSubmatch(line)
+			if match == nil {
+				continue
+			}
+
+			var text []string
+			for _, textLine := range block[i+1:] {
+				if textLine = strings.TrimSpace(subtitleTagRegexp.ReplaceAllString(textLine, "")); textLine != "" {
+					text = append(text, textLine)
+				}
+			}
+
+			if len(text) > 0 {
+				cues = append(cues, Cue{
+					Start: srtTimestamp(match[1:5]),
+					End:   srtTimestamp(match[5:9]),
+					Text:  strings.Join(text, " "),
+				})
+			}
+			break
+		}
+		block = block[:0]
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			flush()
+			continue
+		}
+		block = append(block, line)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	flush()
+
+	return cues, nil
+}
+
+func srtTimestamp(parts []string) time.Duration {
+	h, _ := strconv.Atoi(parts[0])
+	m, _ := strconv.Atoi(parts[1])
+	s, _ := strconv.Atoi(parts[2])
+	ms, _ := strconv.Atoi(parts[3])
+
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(s)*time.Second + time.Duration(ms)*time.Millisecond
+}
+
+// textSubtitleStream picks the subtitle stream to index from the part. Streams in the language are preferred, followed
+// by the selected and default streams. Image subtitles can't be indexed so they're ignored.
+func textSubtitleStream(part operations.GetMetadataPart, language string) (int, bool) {
+	best, bestScore := 0, -1
+	for _, stream := range part.Stream {
+		if stream.StreamType == nil || *stream.StreamType != plexStreamTypeSubtitle || stream.ID == nil {
+			continue
+		}
+		if stream.Codec != nil && imageSubtitleCodecs[*stream.Codec] {
+			continue
+		}
+
+		score := 0
+		if language != "" && stream.LanguageCode != nil && strings.EqualFold(*stream.LanguageCode, language) {
+			score += 4
+		}
+		if stream.Selected != nil && *stream.Selected {
+			score += 2
+		}
+		if stream.Default != nil && *stream.Default {
+			score++
+		}
+
+		if score > bestScore {
+			best, bestScore = *stream.ID, score
+		}
+	}
+
+	return best, bestScore >= 0
+}
+
+// IndexQuotes extracts the text subtitles of the rating key's media and adds them to the quote index.
+// It returns the number of cues that were indexed.
+func (a *Application) IndexQuotes(ctx context.Context, ratingKeyStr, language string) (int, error) {
+	metadata, err := a.metadata(ctx, ratingKeyStr)
+	if err != nil {
+		return 0, err
+	}
+
+	media, err := a.selectMedia(*metadata, "", MediaTarget{})
+	if err != nil {
+		return 0, err
+	}
+
+	parts := mediaParts(*media)
+
+	ctx, cancel := a.jobContext(ctx)
+	defer cancel()
+
+	// Each part has its own subtitles, timed from the start of the part
+	var cues []Cue
+	found := false
+	for i, part := range parts {
+		streamID, ok := textSubtitleStream(part.Part, language)
+		if !ok {
+			continue
+		}
+
+		if len(parts) > 1 && part.Duration <= 0 {
+			return 0, fmt.Errorf("duration of part %d is unknown", i+1)
+		}
+
+		subtitles, err := a.subtitleSource(part.Part, strconv.Itoa(streamID))
+		if err != nil {
+			return 0, err
+		}
+
+		srt := &bytes.Buffer{}
+		if err := DoFfmpegSubtitles(ctx, a.readPart(part), subtitles, srt); err != nil {
+			return 0, fmt.Errorf("could not extract subtitles: %w", err)
+		}
+
+		partCues, err := ParseSRT(srt)
+		if err != nil {
+			return 0, fmt.Errorf("could not parse subtitles: %w", err)
+		}
+
+		for _, cue := range partCues {
+			cue.Start += part.Start
+			cue.End += part.Start
+			cues = append(cues, cue)
+		}
+
+		found = true
+	}
+
+	mediaID := 0
+	if media.ID != nil {
+		mediaID = *media.ID
+	}
+
+	// Media without subtitles is still recorded so that indexing the library skips it
+	if err := a.quotes.Replace(ratingKeyStr, mediaID, NewFfmpegParamsMetadata(*metadata).Name(), cues); err != nil {
+		return 0, fmt.Errorf("could not index subtitles: %w", err)
+	}
+
+	if !found {
+		return 0, ErrNoSubtitles
+	}
+
+	return len(cues), nil
+}
+
+type plexLibraryResponse struct {
+	MediaContainer struct {
+		Metadata []struct {
+			RatingKey string `json:"ratingKey"`
+			Type      string `json:"type"`
+		} `json:"Metadata"`
+	} `json:"MediaContainer"`
+}
+
+// IndexLibraryQuotes indexes the subtitles of every movie or episode in the library section.
+// Items that were already indexed, including those without subtitles, are skipped unless force is set.
+func (a *Application) IndexLibraryQuotes(ctx context.Context, sectionKey, language string, force bool) error {
+	if _, err := strconv.Atoi(sectionKey); err != nil {
+		return fmt.Errorf("could not parse library section: %w", err)
+	}
+
+	var library plexLibraryResponse
+	if err := a.plexGet(ctx, "/library/sections/"+sectionKey+"/all", &library); err != nil {
+		return fmt.Errorf("could not get library items: %w", err)
+	}
+
+	// TV libraries list shows, the episodes are listed separately
+	items := library.MediaContainer.Metadata
+	if len(items) > 0 && items[0].Type == "show" {
+		library = plexLibraryResponse{}
+		if err := a.plexGet(ctx, "/library/sections/"+sectionKey+"/allLeaves", &library); err != nil {
+			return fmt.Errorf("could not get library episodes: %w", err)
+		}
+		items = library.MediaContainer.Metadata
+	}
+
+	log.Printf("indexing quotes for %d items in library %s", len(items), sectionKey)
+
+	indexed := 0
+	for _, item := range items {
+		if ctx.Err() != nil {
+			return context.Cause(ctx)
+		}
+
+		if !force {
+			ok, err := a.quotes.Indexed(item.RatingKey)
+			if err != nil {
+				return err
+			}
+			if ok {
+				continue
+			}
+		}
+
+		// Plenty of items don't have text subtitles, so carry on with the rest of the library
+		if _, err := a.IndexQuotes(ctx, item.RatingKey, language); err != nil {
+			log.Printf("could not index quotes for %s: %v", item.RatingKey, err)
+			continue
+		}
+
+		indexed++
+	}
+
+	log.Printf("indexed quotes for %d items in library %s", indexed, sectionKey)
+
+	return nil
+}
+
+// SearchQuotes finds indexed subtitle cues containing the query
+func (a *Application) SearchQuotes(query string, limit int) ([]Quote, error) {
+	if strings.TrimSpace(query) == "" {
+		return nil, fmt.Errorf("query not specified")
+	}
+
+	if limit <= 0 {
+		limit = quotesDefaultLimit
+	}
+
+	return a.quotes.Search(query, min(limit, quotesMaxLimit))
+}
+
+// Quote looks up a quote returned by SearchQuotes
+func (a *Application) Quote(id int64) (*Quote, error) {
+	return a.quotes.Quote(id)
+}
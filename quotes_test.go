@@ -0,0 +1,190 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSRT(t *testing.T) {
+	ms := time.Millisecond
+
+	tests := []struct {
+		name string
+		in   string
+		want []Cue
+	}{
+		{
+			name: "cues",
+			in: "1\n00:00:01,000 --> 00:00:02,500\nHello there.\n\n" +
+				"2\n00:01:02,003 --> 00:01:04,000\nGeneral Kenobi!\n",
+			want: []Cue{
+				{Start: time.Second, End: 2500 * ms, Text: "Hello there."},
+				{Start: time.Minute + 2*time.Second + 3*ms, End: time.Minute + 4*time.Second, Text: "General Kenobi!"},
+			},
+		},
+		{
+			name: "multiple lines",
+			in:   "1\n00:00:01,000 --> 00:00:02,000\nFirst line\nSecond line\n",
+			want: []Cue{{Start: time.Second, End: 2 * time.Second, Text: "First line Second line"}},
+		},
+		{
+			name: "formatting tags",
+			in:   "1\n00:00:01,000 --> 00:00:02,000\n{\\an8}<i>Whispering</i>\n",
+			want: []Cue{{Start: time.Second, End: 2 * time.Second, Text: "Whispering"}},
+		},
+		{
+			name: "crlf and dots",
+			in:   "1\r\n01:00:00.100 --> 01:00:01.200\r\nWindows\r\n\r\n",
+			want: []Cue{{Start: time.Hour + 100*ms, End: time.Hour + time.Second + 200*ms, Text: "Windows"}},
+		},
+		{
+			name: "missing sequence number",
+			in:   "00:00:01,000 --> 00:00:02,000\nNo number\n",
+			want: []Cue{{Start: time.Second, End: 2 * time.Second, Text: "No number"}},
+		},
+		{
+			name: "empty text",
+			in:   "1\n00:00:01,000 --> 00:00:02,000\n<i></i>\n\n2\n00:00:03,000 --> 00:00:04,000\nKept\n",
+			want: []Cue{{Start: 3 * time.Second, End: 4 * time.Second, Text: "Kept"}},
+		},
+		{
+			name: "no timing",
+			in:   "1\nNot a cue\n",
+		},
+		{
+			name: "empty",
+			in:   "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseSRT(strings.NewReader(tt.in))
+			if err != nil {
+				t.Fatalf("ParseSRT returned an error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseSRT() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// quoteIDs returns the IDs of the quotes that the search finds, keyed by their text
+func quoteIDs(t *testing.T, q *QuoteIndex, query string) map[string]int64 {
+	t.Helper()
+
+	quotes, err := q.Search(query, quotesMaxLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := map[string]int64{}
+	for _, quote := range quotes {
+		ids[quote.Text] = quote.ID
+	}
+	return ids
+}
+
+func TestQuoteIndexReplace(t *testing.T) {
+	q, err := NewQuoteIndex(filepath.Join(t.TempDir(), "quotes.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	cues := []Cue{
+		{Start: time.Second, End: 2 * time.Second, Text: "the first line"},
+		{Start: 3 * time.Second, End: 4 * time.Second, Text: "the second line"},
+	}
+	if err := q.Replace("100", 1, "Movie", cues); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Replace("200", 2, "Other movie", cues); err != nil {
+		t.Fatal(err)
+	}
+	before := quoteIDs(t, q, "line")
+
+	// Reindexing keeps the IDs of the cues, even when other cues are added before them
+	cues = append([]Cue{{Start: 0, End: time.Second, Text: "a new line"}}, cues...)
+	if err := q.Replace("100", 1, "Movie", cues); err != nil {
+		t.Fatal(err)
+	}
+	after := quoteIDs(t, q, "line")
+
+	for _, text := range []string{"the first line", "the second line"} {
+		if after[text] != before[text] {
+			t.Errorf("ID of %q changed from %d to %d", text, before[text], after[text])
+		}
+	}
+
+	quote, err := q.Quote(after["a new line"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quote.RatingKey != "100" || quote.Start != 0 {
+		t.Errorf("Quote() = %+v, want the new line", quote)
+	}
+
+	// Cues that start together share an ID, so they're combined
+	if err := q.Replace("300", 3, "Third movie", []Cue{
+		{Start: time.Second, End: 2 * time.Second, Text: "speaker one"},
+		{Start: time.Second, End: 3 * time.Second, Text: "speaker two"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	quotes, err := q.Search("speaker", quotesMaxLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(quotes) != 1 || quotes[0].Text != "speaker one speaker two" || quotes[0].End != 3*time.Second {
+		t.Errorf("Search() = %+v, want the combined cues", quotes)
+	}
+
+	// Media without subtitles is recorded as indexed
+	if err := q.Replace("400", 4, "Silent movie", nil); err != nil {
+		t.Fatal(err)
+	}
+	if indexed, err := q.Indexed("400"); err != nil || !indexed {
+		t.Errorf("Indexed() = %v, %v, want true", indexed, err)
+	}
+}
+
+func TestQuoteIndexMigrate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quotes.db")
+
+	// Indexes from before quote IDs were stable are cleared, since their docids would collide with the new IDs
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`
+		CREATE VIRTUAL TABLE quotes USING fts4(text, rating_key, media_id, title, start_ms, end_ms);
+		INSERT INTO quotes (text, rating_key, media_id, title, start_ms, end_ms) VALUES ('old line', '100', 1, 'Movie', 0, 1000);
+		CREATE TABLE quote_items (rating_key TEXT PRIMARY KEY, indexed_at INTEGER NOT NULL);
+		INSERT INTO quote_items VALUES ('100', 0);
+	`)
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q, err := NewQuoteIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	if ids := quoteIDs(t, q, "line"); len(ids) != 0 {
+		t.Errorf("old quotes weren't cleared: %v", ids)
+	}
+	if indexed, err := q.Indexed("100"); err != nil || indexed {
+		t.Errorf("Indexed() = %v, %v, want false", indexed, err)
+	}
+}
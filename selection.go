@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+
+	"github.com/LukeHagar/plexgo/models/operations"
+)
+
+// DefaultTargetHeight is the height versions are compared against when a clip keeps the source resolution
+const DefaultTargetHeight = 1080
+
+// MediaPreference is one of the criteria that versions of an item are ranked by when no media ID is requested
+type MediaPreference string
+
+const (
+	// MediaPreferResolution prefers the version closest to the requested height, favouring versions that are
+	// downscaled over ones that would have to be upscaled
+	MediaPreferResolution MediaPreference = "resolution"
+	// MediaPreferDecoder prefers versions in a codec that the encoder's hardware can decode
+	MediaPreferDecoder MediaPreference = "decoder"
+	// MediaPreferLocal prefers versions whose files can be read directly from the filesystem rather than from Plex
+	MediaPreferLocal MediaPreference = "local"
+	// MediaPreferSDR prefers 8-bit versions, which don't need to be tonemapped
+	MediaPreferSDR MediaPreference = "sdr"
+)
+
+// DefaultMediaSelection ranks versions by resolution first, and then by how cheap they are to read and decode
+var DefaultMediaSelection = []MediaPreference{
+	MediaPreferResolution,
+	MediaPreferDecoder,
+	MediaPreferLocal,
+	MediaPreferSDR,
+}
+
+// hwDecoders are the Plex video codecs that each hardware acceleration method can decode. Support varies by GPU
+// generation, so these are the codecs that current hardware decodes.
+var hwDecoders = map[HWAccel][]string{
+	HWAccelVAAPI: {"h264", "hevc", "vp9", "av1", "mpeg2video", "vc1"},
+	HWAccelCUDA:  {"h264", "hevc", "vp9", "av1", "mpeg2video", "mpeg4", "vc1"},
+	HWAccelQSV:   {"h264", "hevc", "vp9", "av1", "mpeg2video", "vc1"},
+}
+
+func ParseMediaPreference(s string) (MediaPreference, error) {
+	switch MediaPreference(s) {
+	case MediaPreferResolution, MediaPreferDecoder, MediaPreferLocal, MediaPreferSDR:
+		return MediaPreference(s), nil
+	default:
+		return "", fmt.Errorf("unknown media preference %q", s)
+	}
+}
+
+// ParseMediaSelection validates the preferences, returning the default order if there are none
+func ParseMediaSelection(preferences []MediaPreference) ([]MediaPreference, error) {
+	if len(preferences) == 0 {
+		return DefaultMediaSelection, nil
+	}
+
+	var parsed []MediaPreference
+	for _, p := range preferences {
+		preference, err := ParseMediaPreference(string(p))
+		if err != nil {
+			return nil, err
+		}
+		if slices.Contains(parsed, preference) {
+			return nil, fmt.Errorf("media preference %q is listed more than once", preference)
+		}
+		parsed = append(parsed, preference)
+	}
+
+	return parsed, nil
+}
+
+// MediaTarget is what the selected version is going to be encoded to. Zero values use the configured defaults.
+type MediaTarget struct {
+	Height  int
+	Codec   Codec
+	HDRMode HDRMode
+}
+
+// selectMedia returns the media with the given ID, or if no ID is specified, the version that ranks best by the
+// configured preferences for the target. Ties keep the order that Plex lists the versions in.
+func (a *Application) selectMedia(metadata operations.GetMetadataMetadata, mediaIdStr string, target MediaTarget) (*operations.GetMetadataMedia, error) {
+	if mediaIdStr != "" {
+		mediaId, err := strconv.Atoi(mediaIdStr)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse media id: %w", err)
+		}
+
+		for i, m := range metadata.Media {
+			if m.ID != nil && *m.ID == mediaId && hasPart(m) {
+				return &metadata.Media[i], nil
+			}
+		}
+	}
+
+	if target.Height <= 0 {
+		target.Height = a.config.Media.TargetHeight
+	}
+	if target.Codec == "" {
+		target.Codec = a.capabilities.Usable(a.config.Ffmpeg.Codec)
+	}
+	if target.HDRMode == "" {
+		target.HDRMode = a.config.Ffmpeg.HDR
+	}
+
+	var candidates []int
+	for i, m := range metadata.Media {
+		if hasPart(m) {
+			candidates = append(candidates, i)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("could not find suitable media for rating key")
+	}
+
+	ranks := make(map[int][]int, len(candidates))
+	for _, i := range candidates {
+		for _, preference := range a.config.Media.Selection {
+			ranks[i] = append(ranks[i], a.mediaRank(metadata.Media[i], preference, target))
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return slices.Compare(ranks[candidates[i]], ranks[candidates[j]]) < 0
+	})
+
+	return &metadata.Media[candidates[0]], nil
+}
+
+// mediaRank scores the media by a single preference, lower is better
+func (a *Application) mediaRank(media operations.GetMetadataMedia, preference MediaPreference, target MediaTarget) int {
+	source := NewVideoSource(media)
+
+	switch preference {
+	case MediaPreferResolution:
+		height := source.nominalHeight()
+		switch {
+		case height == 0:
+			return 1 << 30
+		case height >= target.Height:
+			return height - target.Height
+		default:
+			// Any version that's at least the target height is better than one that has to be upscaled
+			return 1<<20 + target.Height - height
+		}
+	case MediaPreferDecoder:
+		if canHWDecode(media, target.Codec.HWAccel()) {
+			return 0
+		}
+		return 1
+	case MediaPreferLocal:
+		for _, part := range media.Part {
+			if _, ok := a.localPath(part); !ok {
+				return 1
+			}
+		}
+		return 0
+	case MediaPreferSDR:
+		if source.Is10Bit() && target.HDRMode != HDRModeKeep {
+			return 1
+		}
+		return 0
+	default:
+		return 0
+	}
+}
+
+// canHWDecode reports whether the hardware acceleration method can decode the media's video. Software encodes decode
+// everything in software, so every codec is equally suitable for them.
+func canHWDecode(media operations.GetMetadataMedia, hwAccel HWAccel) bool {
+	if hwAccel == HWAccelNone {
+		return true
+	}
+
+	codec := deref(media.VideoCodec)
+	// Hardware decoders only support 8-bit H.264
+	if codec == "h264" && NewVideoSource(media).Is10Bit() {
+		return false
+	}
+
+	return slices.Contains(hwDecoders[hwAccel], codec)
+}
+
+// hasPart reports whether the media has a file that can be read
+func hasPart(media operations.GetMetadataMedia) bool {
+	return len(media.Part) > 0 && media.Part[0].Key != nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+
+	"github.com/LukeHagar/plexgo"
+	"github.com/LukeHagar/plexgo/models/operations"
+)
+
+// testVersion returns a version of an item with a single part, which is read from file if it's set
+func testVersion(id, width, height int, codec string, bitDepth int, file string) operations.GetMetadataMedia {
+	part := operations.GetMetadataPart{
+		Key: plexgo.String("/library/parts/" + strconv.Itoa(id) + "/file.mkv"),
+		Stream: []operations.Stream{
+			{StreamType: plexgo.Int(1), BitDepth: plexgo.Int(bitDepth)},
+		},
+	}
+	if file != "" {
+		part.File = plexgo.String(file)
+	}
+
+	return operations.GetMetadataMedia{
+		ID:         plexgo.Int(id),
+		Width:      plexgo.Int(width),
+		Height:     plexgo.Int(height),
+		VideoCodec: plexgo.String(codec),
+		Part:       []operations.GetMetadataPart{part},
+	}
+}
+
+func TestSelectMedia(t *testing.T) {
+	local := filepath.Join(t.TempDir(), "movie.mkv")
+	if err := os.WriteFile(local, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	uhd := testVersion(1, 3840, 2160, "hevc", 10, "")
+	fhd := testVersion(2, 1920, 1080, "h264", 8, "")
+	hd := testVersion(3, 1280, 720, "h264", 8, "")
+	widescreen := testVersion(4, 1920, 800, "h264", 8, "")
+	unknown := testVersion(5, 0, 0, "h264", 8, "")
+	mpeg4 := testVersion(6, 1920, 1080, "mpeg4", 8, "")
+	hevc := testVersion(7, 1920, 1080, "hevc", 8, "")
+	localFHD := testVersion(8, 1920, 1080, "h264", 8, local)
+	tenBitFHD := testVersion(9, 1920, 1080, "hevc", 10, "")
+	tenBitH264 := testVersion(10, 1920, 1080, "h264", 10, "")
+	localHD := testVersion(11, 1280, 720, "h264", 8, local)
+	noPart := operations.GetMetadataMedia{ID: plexgo.Int(12), Width: plexgo.Int(1920), Height: plexgo.Int(1080)}
+
+	software := MediaTarget{Height: 1080, Codec: CodecLibx264, HDRMode: HDRModeTonemap}
+	vaapi := MediaTarget{Height: 1080, Codec: CodecH264VAAPI, HDRMode: HDRModeTonemap}
+
+	tests := []struct {
+		name      string
+		versions  []operations.GetMetadataMedia
+		selection []MediaPreference
+		mediaID   string
+		target    MediaTarget
+		wantID    int
+		wantErr   bool
+	}{
+		{name: "target height", versions: []operations.GetMetadataMedia{uhd, fhd, hd}, target: software, wantID: 2},
+		{
+			name:     "smaller target height",
+			versions: []operations.GetMetadataMedia{uhd, fhd, hd},
+			target:   MediaTarget{Height: 720, Codec: CodecLibx264, HDRMode: HDRModeTonemap},
+			wantID:   3,
+		},
+		{
+			name:     "downscaled over upscaled",
+			versions: []operations.GetMetadataMedia{hd, fhd},
+			target:   MediaTarget{Height: 900, Codec: CodecLibx264, HDRMode: HDRModeTonemap},
+			wantID:   2,
+		},
+		{
+			name:     "configured target height",
+			versions: []operations.GetMetadataMedia{fhd, hd},
+			target:   MediaTarget{Codec: CodecLibx264, HDRMode: HDRModeTonemap},
+			wantID:   3,
+		},
+		{name: "widescreen counts as 1080p", versions: []operations.GetMetadataMedia{hd, widescreen}, target: software, wantID: 4},
+		{name: "unknown resolution last", versions: []operations.GetMetadataMedia{unknown, hd}, target: software, wantID: 3},
+		{name: "hardware decoder", versions: []operations.GetMetadataMedia{mpeg4, hevc}, target: vaapi, wantID: 7},
+		{name: "software decodes anything", versions: []operations.GetMetadataMedia{mpeg4, hevc}, target: software, wantID: 6},
+		{
+			name:     "no hardware decoding of 10-bit H.264",
+			versions: []operations.GetMetadataMedia{tenBitH264, tenBitFHD},
+			target:   MediaTarget{Height: 1080, Codec: CodecH264VAAPI, HDRMode: HDRModeKeep},
+			wantID:   9,
+		},
+		{name: "local file", versions: []operations.GetMetadataMedia{fhd, localFHD}, target: software, wantID: 8},
+		{name: "sdr when tonemapping", versions: []operations.GetMetadataMedia{tenBitFHD, hevc}, target: software, wantID: 7},
+		{
+			name:     "10-bit when keeping HDR",
+			versions: []operations.GetMetadataMedia{tenBitFHD, hevc},
+			target:   MediaTarget{Height: 1080, Codec: CodecLibx264, HDRMode: HDRModeKeep},
+			wantID:   9,
+		},
+		{name: "ties keep Plex's order", versions: []operations.GetMetadataMedia{hevc, fhd}, target: software, wantID: 7},
+		{
+			name:      "configured order",
+			versions:  []operations.GetMetadataMedia{fhd, localHD},
+			selection: []MediaPreference{MediaPreferLocal, MediaPreferResolution},
+			target:    software,
+			wantID:    11,
+		},
+		{name: "requested media", versions: []operations.GetMetadataMedia{fhd, hd}, mediaID: "3", target: software, wantID: 3},
+		{name: "unknown requested media", versions: []operations.GetMetadataMedia{fhd, hd}, mediaID: "99", target: software, wantID: 2},
+		{name: "requested media without a part", versions: []operations.GetMetadataMedia{noPart, hd}, mediaID: "12", target: software, wantID: 3},
+		{name: "invalid media id", versions: []operations.GetMetadataMedia{fhd}, mediaID: "first", target: software, wantErr: true},
+		{name: "no parts", versions: []operations.GetMetadataMedia{noPart}, target: software, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := testApplication()
+			a.config.Media.TargetHeight = 720
+			a.config.Media.Selection = tt.selection
+			if a.config.Media.Selection == nil {
+				a.config.Media.Selection = DefaultMediaSelection
+			}
+
+			got, err := a.selectMedia(operations.GetMetadataMetadata{Media: tt.versions}, tt.mediaID, tt.target)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("selectMedia() = media %d, want an error", deref(got.ID))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("selectMedia() returned an error: %v", err)
+			}
+			if deref(got.ID) != tt.wantID {
+				t.Errorf("selectMedia() = media %d, want media %d", deref(got.ID), tt.wantID)
+			}
+		})
+	}
+}
+
+func TestParseMediaSelection(t *testing.T) {
+	tests := []struct {
+		name        string
+		preferences []MediaPreference
+		want        []MediaPreference
+		wantErr     bool
+	}{
+		{name: "default", want: DefaultMediaSelection},
+		{name: "custom", preferences: []MediaPreference{"local", "sdr"}, want: []MediaPreference{MediaPreferLocal, MediaPreferSDR}},
+		{name: "unknown", preferences: []MediaPreference{"bitrate"}, wantErr: true},
+		{name: "repeated", preferences: []MediaPreference{"local", "local"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseMediaSelection(tt.preferences)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseMediaSelection() returned %v, want an error: %t", err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("ParseMediaSelection() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
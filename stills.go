@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"io/fs"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// frameCacheTTL is how long extracted frames are kept on disk
+	frameCacheTTL = time.Hour
+
+	filmstripMaxFrames      = 100
+	filmstripColumns        = 10
+	filmstripDefaultHeight  = 90
+	filmstripConcurrentJobs = 4
+)
+
+// FrameSource selects where filmstrip and frame images come from
+type FrameSource string
+
+const (
+	// FrameSourceAuto uses Plex's index thumbnails for filmstrips when they're available, and ffmpeg otherwise
+	FrameSourceAuto FrameSource = ""
+	// FrameSourceBIF uses Plex's index thumbnails, which are quick to load but low resolution
+	FrameSourceBIF FrameSource = "bif"
+	// FrameSourceFfmpeg extracts frames from the media with ffmpeg
+	FrameSourceFfmpeg FrameSource = "ffmpeg"
+)
+
+func ParseFrameSource(s string) (FrameSource, error) {
+	switch FrameSource(s) {
+	case FrameSourceAuto, FrameSourceBIF, FrameSourceFfmpeg:
+		return FrameSource(s), nil
+	default:
+		return "", fmt.Errorf("unknown frame source %q", s)
+	}
+}
+
+// ImageFormat is the format screenshots are exported as
+type ImageFormat string
+
+const (
+	ImageFormatPNG  ImageFormat = "png"
+	ImageFormatJPEG ImageFormat = "jpeg"
+	ImageFormatWebP ImageFormat = "webp"
+)
+
+func ParseImageFormat(s string) (ImageFormat, error) {
+	switch ImageFormat(strings.ToLower(s)) {
+	case "", ImageFormatPNG:
+		return ImageFormatPNG, nil
+	case ImageFormatJPEG, "jpg":
+		return ImageFormatJPEG, nil
+	case ImageFormatWebP:
+		return ImageFormatWebP, nil
+	default:
+		return "", fmt.Errorf("unknown image format %q", s)
+	}
+}
+
+func (f ImageFormat) Ext() string {
+	if f == ImageFormatJPEG {
+		return ".jpg"
+	}
+	return "." + string(f)
+}
+
+// ScreenshotOptions are the user-provided options that modify the resulting screenshot
+type ScreenshotOptions struct {
+	Format  ImageFormat
+	Height  int
+	HDRMode HDRMode
+	// SubtitleStreamID is the Plex ID of the subtitle stream to burn in, if any
+	SubtitleStreamID string
+}
+
+// FrameCache keeps frames extracted by ffmpeg on disk
+type FrameCache struct {
+	dir string
+}
+
+func NewFrameCache(dir string) *FrameCache {
+	cache := &FrameCache{
+		dir: dir,
+	}
+
+	go cache.expire()
+
+	return cache
+}
+
+// Frame returns the path to the cached frame, calling extract to write it to a temporary path if it isn't cached
+func (c *FrameCache) Frame(name string, extract func(path string) error) (string, error) {
+	path := filepath.Join(c.dir, name)
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", err
+	}
+
+	// Extract to a temporary file so that concurrent requests never see a partially written frame
+	tmpPath := fmt.Sprintf("%s.%d.tmp%s", path, time.Now().UnixNano(), filepath.Ext(path))
+	if err := extract(tmpPath); err != nil {
+		return "", err
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+func (c *FrameCache) Close() error {
+	return os.RemoveAll(c.dir)
+}
+
+func (c *FrameCache) expire() {
+	for range time.Tick(10 * time.Minute) {
+		err := filepath.WalkDir(c.dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			if time.Since(info.ModTime()) > frameCacheTTL {
+				return os.Remove(path)
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("could not remove expired frames: %v", err)
+		}
+	}
+}
+
+// Frame extracts a single frame with ffmpeg and returns the path to the JPEG
+func (a *Application) Frame(ctx context.Context, ratingKeyStr, mediaIdStr string, at time.Duration, height int) (string, error) {
+	source, err := a.MediaSource(ctx, ratingKeyStr, mediaIdStr)
+	if err != nil {
+		return "", err
+	}
+
+	return a.frame(ctx, ratingKeyStr, source, at, height)
+}
+
+func (a *Application) frame(ctx context.Context, ratingKeyStr string, source *MediaSource, at time.Duration, height int) (string, error) {
+	if at < 0 || (source.Duration > 0 && at >= source.Duration) {
+		return "", fmt.Errorf("frame timestamp is outside of the media")
+	}
+
+	part, partTime, err := partAt(source.Parts, at)
+	if err != nil {
+		return "", err
+	}
+
+	name := fmt.Sprintf("%s-%d/%d-%d.jpg", ratingKeyStr, source.MediaID, at.Milliseconds(), height)
+	input := a.readPart(part)
+
+	// Each frame is its own ffmpeg job, so the filmstrip's frames each get the full timeout
+	ctx, cancel := a.jobContext(ctx)
+	defer cancel()
+
+	return a.frames.Frame(name, func(path string) error {
+		return DoFfmpegFrame(ctx, FrameParams{
+			Input:  input,
+			At:     partTime,
+			Height: height,
+			Source: source.Source,
+			Path:   path,
+		})
+	})
+}
+
+// Screenshot extracts the frame at the timestamp and returns the path to the image and the name it should be downloaded as
+func (a *Application) Screenshot(ctx context.Context, ratingKeyStr, mediaIdStr string, at time.Duration, opts ScreenshotOptions) (string, string, error) {
+	metadata, err := a.metadata(ctx, ratingKeyStr)
+	if err != nil {
+		return "", "", err
+	}
+
+	// Frames are decoded in software
+	media, err := a.selectMedia(*metadata, mediaIdStr, MediaTarget{
+		Height:  opts.Height,
+		Codec:   CodecLibx264,
+		HDRMode: opts.HDRMode,
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	source := a.newMediaSource(*metadata, *media)
+	if at < 0 || (source.Duration > 0 && at >= source.Duration) {
+		return "", "", fmt.Errorf("screenshot timestamp is outside of the media")
+	}
+
+	part, partTime, err := partAt(source.Parts, at)
+	if err != nil {
+		return "", "", err
+	}
+
+	params := FrameParams{
+		Input:   a.readPart(part),
+		At:      partTime,
+		Height:  opts.Height,
+		Source:  source.Source,
+		HDRMode: opts.HDRMode,
+	}
+
+	// Each part has its own subtitle streams
+	if opts.SubtitleStreamID != "" {
+		params.Subtitles, err = a.subtitleSource(part.Part, opts.SubtitleStreamID)
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	fileName := fmt.Sprintf("%s (%s)%s", NewFfmpegParamsMetadata(*metadata).Name(), FormatTimestamp(at), opts.Format.Ext())
+
+	// Screenshots are cached alongside the frames since the same moment tends to be requested repeatedly
+	name := fmt.Sprintf("%s-%d/screenshot-%d-%d-%s-%s%s",
+		ratingKeyStr, source.MediaID, at.Milliseconds(), opts.Height, opts.HDRMode, opts.SubtitleStreamID, opts.Format.Ext())
+
+	ctx, cancel := a.jobContext(ctx)
+	defer cancel()
+
+	path, err := a.frames.Frame(name, func(path string) error {
+		params.Path = path
+		return DoFfmpegFrame(ctx, params)
+	})
+
+	return path, fileName, err
+}
+
+// Filmstrip is a sprite sheet of evenly spaced frames, laid out left to right and then top to bottom
+type Filmstrip struct {
+	// Image is a JPEG
+	Image      []byte
+	Columns    int
+	Rows       int
+	Timestamps []time.Duration
+}
+
+// FilmstripTimestamps returns count evenly spaced timestamps between from and to,
+// each in the middle of its section of the range
+func FilmstripTimestamps(from, to time.Duration, count int) []time.Duration {
+	step := (to - from) / time.Duration(count)
+
+	timestamps := make([]time.Duration, count)
+	for i := range timestamps {
+		timestamps[i] = from + step*time.Duration(i) + step/2
+	}
+
+	return timestamps
+}
+
+// Filmstrip builds a sprite sheet of count frames between from and to. If to is 0, the end of the media is used.
+func (a *Application) Filmstrip(ctx context.Context, ratingKeyStr, mediaIdStr string, from, to time.Duration, count, height int, frameSource FrameSource) (*Filmstrip, error) {
+	if count < 1 || count > filmstripMaxFrames {
+		return nil, fmt.Errorf("count must be between 1 and %d", filmstripMaxFrames)
+	}
+
+	source, err := a.MediaSource(ctx, ratingKeyStr, mediaIdStr)
+	if err != nil {
+		return nil, err
+	}
+
+	if to <= 0 || to > source.Duration {
+		to = source.Duration
+	}
+	if from >= to {
+		return nil, fmt.Errorf("from must be before to")
+	}
+
+	if height <= 0 {
+		height = filmstripDefaultHeight
+	}
+
+	timestamps := FilmstripTimestamps(from, to, count)
+	frames := make([][]byte, count)
+
+	bifFrames := false
+	if frameSource != FrameSourceFfmpeg {
+		err = a.bifFrames(ctx, source, timestamps, frames)
+		if err != nil && (frameSource == FrameSourceBIF || !errors.Is(err, ErrNoBIF)) {
+			return nil, err
+		}
+		bifFrames = err == nil
+	}
+
+	if !bifFrames {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		var wg sync.WaitGroup
+		var errOnce sync.Once
+		var firstErr error
+		sem := make(chan struct{}, filmstripConcurrentJobs)
+
+		for i, t := range timestamps {
+			wg.Add(1)
+			go func(i int, t time.Duration) {
+				defer wg.Done()
+
+				sem <- struct{}{}
+				defer func() { <-sem }()
+
+				path, err := a.frame(ctx, ratingKeyStr, source, t, height)
+				if err == nil {
+					frames[i], err = os.ReadFile(path)
+				}
+				if err != nil {
+					// Don't bother extracting the remaining frames, the other extractions will fail with cancellation errors
+					errOnce.Do(func() {
+						firstErr = err
+						cancel()
+					})
+				}
+			}(i, t)
+		}
+
+		wg.Wait()
+
+		if firstErr != nil {
+			return nil, firstErr
+		}
+	}
+
+	return newFilmstrip(frames, timestamps)
+}
+
+// bifFrames fills frames with the index thumbnails closest to the timestamps. Each part of the media has its own
+// index thumbnails, timed from the start of the part.
+func (a *Application) bifFrames(ctx context.Context, source *MediaSource, timestamps []time.Duration, frames [][]byte) error {
+	bifs := map[int]*BIF{}
+
+	for i, t := range timestamps {
+		part, partTime, err := partAt(source.Parts, t)
+		if err != nil {
+			return err
+		}
+
+		partID := deref(part.Part.ID)
+		bif, ok := bifs[partID]
+		if !ok {
+			bif, err = a.BIF(ctx, partID)
+			if err != nil {
+				return err
+			}
+			bifs[partID] = bif
+		}
+
+		frames[i] = bif.FrameAt(partTime).Image
+	}
+
+	return nil
+}
+
+func newFilmstrip(frames [][]byte, timestamps []time.Duration) (*Filmstrip, error) {
+	images := make([]image.Image, len(frames))
+	for i, frame := range frames {
+		img, err := jpeg.Decode(bytes.NewReader(frame))
+		if err != nil {
+			return nil, fmt.Errorf("could not decode frame: %w", err)
+		}
+		images[i] = img
+	}
+
+	// All frames come from the same media so they're the same size
+	cell := images[0].Bounds().Size()
+	columns := min(len(images), filmstripColumns)
+	rows := int(math.Ceil(float64(len(images)) / float64(columns)))
+
+	sprite := image.NewRGBA(image.Rect(0, 0, cell.X*columns, cell.Y*rows))
+	for i, img := range images {
+		origin := image.Pt((i%columns)*cell.X, (i/columns)*cell.Y)
+		draw.Draw(sprite, image.Rectangle{Min: origin, Max: origin.Add(cell)}, img, img.Bounds().Min, draw.Src)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := jpeg.Encode(buf, sprite, &jpeg.Options{Quality: 80}); err != nil {
+		return nil, fmt.Errorf("could not encode filmstrip: %w", err)
+	}
+
+	return &Filmstrip{
+		Image:      buf.Bytes(),
+		Columns:    columns,
+		Rows:       rows,
+		Timestamps: timestamps,
+	}, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/LukeHagar/plexgo/models/operations"
+)
+
+// plexStreamTypeSubtitle is the Plex stream type of subtitle streams
+const plexStreamTypeSubtitle = 3
+
+// imageSubtitleCodecs are subtitle formats made of bitmaps, which have to be overlaid rather than rendered as text
+var imageSubtitleCodecs = map[string]bool{
+	"pgs":               true,
+	"hdmv_pgs_subtitle": true,
+	"dvd_subtitle":      true,
+	"vobsub":            true,
+	"dvb_subtitle":      true,
+}
+
+// SubtitleSource is a subtitle stream to burn into the video
+type SubtitleSource struct {
+	// URL is set for sidecar subtitles that Plex serves separately from the media
+	URL string
+	// List is the concat demuxer list that URL reads when it's read from Plex
+	List string
+	// StreamIndex is the index of an embedded subtitle stream among all the streams in the media
+	StreamIndex int
+	// SubtitleIndex is the index of an embedded subtitle stream among the media's subtitle streams
+	SubtitleIndex int
+	// Image is true for bitmap subtitles such as PGS and VobSub
+	Image bool
+}
+
+// subtitleSource finds the subtitle stream with the Plex stream ID in the part
+func (a *Application) subtitleSource(part operations.GetMetadataPart, streamIDStr string) (*SubtitleSource, error) {
+	streamID, err := strconv.Atoi(streamIDStr)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse subtitle stream id: %w", err)
+	}
+
+	subtitleIndex := 0
+	for _, stream := range part.Stream {
+		if stream.StreamType == nil || *stream.StreamType != plexStreamTypeSubtitle {
+			continue
+		}
+
+		if stream.ID == nil || *stream.ID != streamID {
+			// Sidecar subtitles don't have an index and aren't counted by ffmpeg
+			if stream.Index != nil {
+				subtitleIndex++
+			}
+			continue
+		}
+
+		source := &SubtitleSource{
+			Image: stream.Codec != nil && imageSubtitleCodecs[*stream.Codec],
+		}
+
+		if stream.Index == nil {
+			input := a.plexInput(fmt.Sprintf("%s/library/streams/%d", a.config.Plex.Host, streamID))
+			source.URL, source.List = input.URL, input.List
+			if source.Image {
+				return nil, fmt.Errorf("burning in sidecar image subtitles isn't supported")
+			}
+		} else {
+			source.StreamIndex = *stream.Index
+			source.SubtitleIndex = subtitleIndex
+		}
+
+		return source, nil
+	}
+
+	return nil, fmt.Errorf("subtitle stream %d not found", streamID)
+}
+
+// Filter returns the filter that renders text subtitles onto the video read from inputURL.
+// Image subtitles can't be rendered by a filter, they're overlaid by the caller instead.
+func (s *SubtitleSource) Filter(inputURL string) string {
+	if s.URL != "" {
+		return "subtitles=" + escapeFilterValue(s.URL)
+	}
+
+	return fmt.Sprintf("subtitles=%s:si=%d", escapeFilterValue(inputURL), s.SubtitleIndex)
+}
+
+// escapeFilterValue escapes a filter option value for use in a filtergraph.
+// Values are escaped once for the option and again for the graph, see https://ffmpeg.org/ffmpeg-filters.html#Notes-on-filtergraph-escaping
+func escapeFilterValue(value string) string {
+	value = strings.NewReplacer(`\`, `\\`, `'`, `\'`, `:`, `\:`).Replace(value)
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`, `[`, `\[`, `]`, `\]`, `,`, `\,`, `;`, `\;`).Replace(value)
+}
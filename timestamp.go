@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// timestampField matches a field of a timestamp. Only the seconds, the last field, can have a fraction.
+var timestampField = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?$`)
+
+// ParseTimestamp parses an ffmpeg style timestamp, either [[HH:]MM:]SS[.mmm] or a number of seconds.
+// The minutes and seconds have to be less than 60 when they follow another field.
+func ParseTimestamp(s string) (time.Duration, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) > 3 {
+		return 0, fmt.Errorf("invalid timestamp %q", s)
+	}
+
+	var total float64
+	for i, part := range parts {
+		match := timestampField.FindStringSubmatch(part)
+		if match == nil || (match[1] != "" && i < len(parts)-1) {
+			return 0, fmt.Errorf("invalid timestamp %q", s)
+		}
+
+		value, err := strconv.ParseFloat(part, 64)
+		if err != nil || (i > 0 && value >= 60) {
+			return 0, fmt.Errorf("timestamp %q is out of range", s)
+		}
+		total = total*60 + value
+	}
+
+	if total >= time.Duration(math.MaxInt64).Seconds() {
+		return 0, fmt.Errorf("timestamp %q is out of range", s)
+	}
+
+	return time.Duration(total * float64(time.Second)), nil
+}
+
+// FormatTimestamp formats the duration as HH:MM:SS.mmm, which ffmpeg accepts as a position or duration
+func FormatTimestamp(d time.Duration) string {
+	if d < 0 {
+		d = 0
+	}
+
+	hours := d / time.Hour
+	minutes := (d % time.Hour) / time.Minute
+	seconds := (d % time.Minute) / time.Second
+	millis := (d % time.Second) / time.Millisecond
+
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", hours, minutes, seconds, millis)
+}
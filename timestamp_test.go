@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    time.Duration
+		wantErr bool
+	}{
+		{in: "90", want: 90 * time.Second},
+		{in: "1.5", want: 1500 * time.Millisecond},
+		{in: "01:30", want: 90 * time.Second},
+		{in: "1:02:03", want: time.Hour + 2*time.Minute + 3*time.Second},
+		{in: "00:05:10.500", want: 5*time.Minute + 10*time.Second + 500*time.Millisecond},
+		{in: "00:00:00.000", want: 0},
+		{in: "", wantErr: true},
+		{in: "abc", wantErr: true},
+		{in: "1:2:3:4", wantErr: true},
+		{in: "00:-01:00", wantErr: true},
+		{in: "00::00", wantErr: true},
+		{in: "59:59.999", want: 59*time.Minute + 59*time.Second + 999*time.Millisecond},
+		{in: "100:00:00", want: 100 * time.Hour},
+		{in: "NaN", wantErr: true},
+		{in: "Inf", wantErr: true},
+		{in: "+Inf", wantErr: true},
+		{in: "1e3", wantErr: true},
+		{in: "00:00:1e1", wantErr: true},
+		{in: "0x10", wantErr: true},
+		{in: "+5", wantErr: true},
+		{in: " 5", wantErr: true},
+		{in: "1_000", wantErr: true},
+		{in: ".5", wantErr: true},
+		{in: "5.", wantErr: true},
+		{in: "00:60", wantErr: true},
+		{in: "00:60:00", wantErr: true},
+		{in: "00:00:60.5", wantErr: true},
+		{in: "01.5:00", wantErr: true},
+		{in: "9999999999999", wantErr: true},
+		{in: "99999999999999999999999999999999999999999999", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseTimestamp(tt.in)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParseTimestamp(%q) = %v, want an error", tt.in, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseTimestamp(%q) returned an error: %v", tt.in, err)
+			}
+			if got != tt.want {
+				t.Errorf("ParseTimestamp(%q) = %v, want %v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatTimestamp(t *testing.T) {
+	tests := []struct {
+		in   time.Duration
+		want string
+	}{
+		{in: 0, want: "00:00:00.000"},
+		{in: 5*time.Minute + 10*time.Second + 500*time.Millisecond, want: "00:05:10.500"},
+		{in: 26*time.Hour + time.Millisecond, want: "26:00:00.001"},
+		{in: -time.Second, want: "00:00:00.000"},
+	}
+
+	for _, tt := range tests {
+		if got := FormatTimestamp(tt.in); got != tt.want {
+			t.Errorf("FormatTimestamp(%v) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}